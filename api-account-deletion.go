@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+var accountDeletionModes = []string{"delete", "anonymize"}
+
+func (h *HTTPServer) setupAccountDeletionHandlers(rg *gin.RouterGroup) {
+	rg.POST("/user/:email/deletion-request", accountDeletionRequest())
+	rg.POST("/user/:email/deletion-cancel", accountDeletionCancel())
+}
+
+func accountDeletionRequest() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("accountDeletionRequest email=%s", email)
+
+		_, err := loadAndValidateToken(r, c.Request, "access", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid access token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		err = db.First(&u, "realm = ? AND email = ? AND enabled = 1", r.Name, email).Error
+		if err != nil {
+			c.JSON(455, gin.H{"message": "Invalid account"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		//accounts created by social logins have no password
+		if u.PasswordHash != "" {
+			if !validUserPassword(&u, m["password"]) {
+				c.JSON(470, gin.H{"message": "Invalid current password"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+				return
+			}
+		}
+
+		now := time.Now()
+		deletionDate := now.Add(time.Duration(opt.accountDeletionGraceDays) * 24 * time.Hour)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+				"enabled":               0,
+				"deletion_request_date": now,
+				"deletion_date":         deletionDate,
+			}).Error
+			if err != nil {
+				return err
+			}
+			return saveOutboxEvent(tx, r.Name, "user.disabled", userWebhookData(&u))
+		})
+		if err != nil {
+			logrus.Warnf("Error scheduling deletion of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		subject, htmlBody, ok := r.mailTemplate("account-deletion")
+		if ok {
+			_, cancelTokenString, err := createJWTToken(r, email, opt.accountDeletionGraceDays*24*60, "account-deletion-cancel", "password", nil)
+			if err == nil {
+				htmlBody = renderMailTemplate(htmlBody,
+					"ACCOUNT_DELETION_CANCEL_TOKEN", cancelTokenString,
+					"DELETION_DATE", deletionDate.Format("2006-01-02"),
+					"EMAIL", email,
+					"DISPLAY_NAME", u.Name)
+				err = sendMail(r, subject, htmlBody, email, u.Name)
+			}
+			if err != nil {
+				logrus.Warnf("Couldn't send account deletion confirmation to %s (%s). Reverting deletion request. err=%s", email, subject, err)
+				mailCounter.WithLabelValues("POST", "account-deletion", "500").Inc()
+				db.Transaction(func(tx *gorm.DB) error {
+					err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{"enabled": 1, "deletion_request_date": nil, "deletion_date": nil}).Error
+					if err != nil {
+						return err
+					}
+					return saveOutboxEvent(tx, r.Name, "user.enabled", userWebhookData(&u))
+				})
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+			mailCounter.WithLabelValues("POST", "account-deletion", "202").Inc()
+
+			if opt.mailTokensTests == "true" {
+				logrus.Warnf("ADDING ACCOUNT DELETION CANCEL TOKEN TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
+				c.Header("Test-Token", cancelTokenString)
+			}
+		} else {
+			logrus.Warnf("Mail template 'account-deletion' not configured for realm %s. Deletion of %s can't be cancelled by the user", r.Name, email)
+		}
+
+		logrus.Infof("Account %s disabled and scheduled for deletion at %s", email, deletionDate.Format(time.RFC3339))
+		auditEvent(c, "user.deletion-request", email, email, true, map[string]interface{}{"deletionDate": deletionDate.Format(time.RFC3339)})
+		emitWebhookEvent(r.Name, "user.disabled", userWebhookData(&u))
+		c.JSON(202, gin.H{"message": "Account disabled and scheduled for deletion", "deletionDate": deletionDate.Format(time.RFC3339)})
+		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+	}
+}
+
+func accountDeletionCancel() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("accountDeletionCancel email=%s", email)
+
+		_, err := loadAndValidateToken(r, c.Request, "account-deletion-cancel", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid account deletion cancel token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		db1 := db.First(&u, "realm = ? AND email = ? AND deletion_date > ? AND erasure_date IS NULL", r.Name, email, time.Now())
+		if db1.RecordNotFound() {
+			c.JSON(455, gin.H{"message": "No pending deletion for account"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+		if db1.Error == nil {
+			db1.Error = db.Transaction(func(tx *gorm.DB) error {
+				err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+					"enabled":               1,
+					"deletion_request_date": nil,
+					"deletion_date":         nil,
+				}).Error
+				if err != nil {
+					return err
+				}
+				return saveOutboxEvent(tx, r.Name, "user.enabled", userWebhookData(&u))
+			})
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error cancelling deletion of %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Deletion of account %s cancelled", email)
+		auditEvent(c, "user.deletion-cancel", email, email, true, nil)
+		c.JSON(200, gin.H{"message": "Account deletion cancelled"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//runAccountDeletionWorker periodically erases accounts whose deletion grace period is over
+func runAccountDeletionWorker() {
+	for {
+		users := make([]User, 0)
+		err := db.Find(&users, "deletion_date <= ? AND erasure_date IS NULL", time.Now()).Error
+		if err != nil {
+			logrus.Warnf("Couldn't load accounts scheduled for deletion. err=%s", err)
+		}
+		for _, u := range users {
+			err = eraseUser(&u, opt.accountDeletionMode)
+			if err != nil {
+				logrus.Warnf("Couldn't erase account %s. err=%s", u.ID, err)
+				continue
+			}
+			logrus.Infof("Account %s of realm %s erased (%s)", u.ID, u.Realm, opt.accountDeletionMode)
+			saveAuditEvent(u.Realm, "user.erase", "system", u.ID, "", true, map[string]interface{}{"mode": opt.accountDeletionMode})
+			emitWebhookEvent(u.Realm, "user.deleted", map[string]interface{}{"id": u.ID})
+		}
+		time.Sleep(1 * time.Minute)
+	}
+}
+
+//eraseUser removes all personal data of a user. Mode 'delete' removes the user row, while 'anonymize' keeps it (and its id) with all personal fields cleared
+func eraseUser(u *User, mode string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := pseudonymizeAuditEvents(tx, u)
+		if err != nil {
+			return err
+		}
+		err = deleteUserRows(tx, u)
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(Invitation{}, "realm = ? AND email = ?", u.Realm, u.Email).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(LoginAttempt{}, "realm = ? AND email = ?", u.Realm, u.Email).Error
+		if err != nil {
+			return err
+		}
+		//webhook payloads have the user id, email and name. Failed deliveries are kept for retries, so they would never be removed otherwise
+		err = tx.Delete(WebhookDelivery{}, "realm = ? AND (payload LIKE ? ESCAPE '!' OR payload LIKE ? ESCAPE '!')", u.Realm, jsonValueLikePattern(u.ID), jsonValueLikePattern(u.Email)).Error
+		if err != nil {
+			return err
+		}
+		err = saveOutboxEvent(tx, u.Realm, "user.deleted", map[string]interface{}{"id": u.ID})
+		if err != nil {
+			return err
+		}
+		if mode == "delete" {
+			return tx.Unscoped().Delete(User{}, "id = ?", u.ID).Error
+		}
+		return tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+			"name":                 "Deleted user",
+			"email":                fmt.Sprintf("deleted-%s", u.ID),
+			"password_hash":        "",
+			"activation_code_hash": "",
+			"roles":                "",
+			"locale":               "",
+			"timezone":             "",
+			"phone":                "",
+			"custom_attributes":    "",
+			"avatar_key":           "",
+			"enabled":              0,
+			"erasure_date":         time.Now(),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	if u.AvatarKey != "" {
+		err = blobs.Delete(u.AvatarKey)
+		if err != nil {
+			logrus.Warnf("Couldn't delete avatar blob %s of erased account %s. err=%s", u.AvatarKey, u.ID, err)
+		}
+	}
+	return nil
+}
+
+//deleteUserRows deletes the memberships, email changes, consents, sessions, login attempts and password history of an account
+func deleteUserRows(tx *gorm.DB, u *User) error {
+	err := tx.Delete(Membership{}, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(&Invitation{}).Where("invited_by = ?", u.ID).UpdateColumn("invited_by", "deleted").Error
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(EmailChange{}, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(Consent{}, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(Session{}, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Delete(LoginAttempt{}, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(PasswordHistory{}, "user_id = ?", u.ID).Error
+}
+
+//deleteUnactivatedUser deletes an account that was never activated along with its rows
+func deleteUnactivatedUser(tx *gorm.DB, u *User) error {
+	err := deleteUserRows(tx, u)
+	if err != nil {
+		return err
+	}
+	err = saveOutboxEvent(tx, u.Realm, "user.deleted", map[string]interface{}{"id": u.ID})
+	if err != nil {
+		return err
+	}
+	return tx.Unscoped().Delete(User{}, "id = ?", u.ID).Error
+}
+
+//jsonValueLikePattern returns a LIKE pattern (with '!' as escape character) matching JSON documents with a string value
+func jsonValueLikePattern(value string) string {
+	v, _ := json.Marshal(value)
+	escaped := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![").Replace(string(v))
+	return "%" + escaped + "%"
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupAuditHandlers(rg *gin.RouterGroup) {
+	rg.GET("/admin/audit", adminAuditList())
+	rg.GET("/admin/audit/export", adminAuditExport())
+}
+
+func adminAuditList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 || limit > 1000 {
+			c.JSON(400, gin.H{"message": "Invalid limit. Must be between 1 and 1000"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(400, gin.H{"message": "Invalid offset"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		q, valid := processAuditQuery(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		total := 0
+		err = q.Model(&AuditEvent{}).Count(&total).Error
+		if err != nil {
+			logrus.Warnf("Error counting audit events. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		events := make([]AuditEvent, 0)
+		err = q.Order("date DESC").Limit(limit).Offset(offset).Find(&events).Error
+		if err != nil {
+			logrus.Warnf("Error listing audit events. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		resp := make([]gin.H, 0)
+		for _, ev := range events {
+			resp = append(resp, auditEventResponse(ev))
+		}
+		c.JSON(200, gin.H{"total": total, "limit": limit, "offset": offset, "events": resp})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminAuditExport() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		q, valid := processAuditQuery(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		rows, err := q.Model(&AuditEvent{}).Order("date").Rows()
+		if err != nil {
+			logrus.Warnf("Error exporting audit events. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		defer rows.Close()
+
+		//events are streamed as JSON lines, so the export size is not limited by memory
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Header("Content-Disposition", "attachment; filename=\"userme-audit.jsonl\"")
+		c.Status(200)
+		enc := json.NewEncoder(c.Writer)
+		count := 0
+		for rows.Next() {
+			var ev AuditEvent
+			err = db.ScanRows(rows, &ev)
+			if err == nil {
+				err = enc.Encode(auditEventResponse(ev))
+			}
+			if err != nil {
+				logrus.Warnf("Audit export interrupted after %d events. err=%s", count, err)
+				break
+			}
+			count++
+		}
+		logrus.Infof("%d audit events exported", count)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//processAuditQuery builds the audit events query of the current realm from the request filters
+func processAuditQuery(c *gin.Context, pmethod string, ppath string) (*gorm.DB, bool) {
+	q := db.Where("realm = ?", getRealm(c).Name)
+
+	types := c.Query("type")
+	if types != "" {
+		q = q.Where("type IN (?)", strings.Split(types, ","))
+	}
+	for _, f := range []string{"actor", "target", "outcome"} {
+		v := c.Query(f)
+		if v != "" {
+			q = q.Where(f+" = ?", strings.ToLower(v))
+		}
+	}
+	for _, f := range []struct{ param, where string }{{"from", "date >= ?"}, {"to", "date < ?"}} {
+		v := c.Query(f.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(400, gin.H{"message": "Invalid '" + f.param + "' date. Use RFC3339 format, as in 2020-01-31T10:00:00Z"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return nil, false
+		}
+		q = q.Where(f.where, t)
+	}
+	return q, true
+}
+
+func auditEventResponse(ev AuditEvent) gin.H {
+	details := make(map[string]interface{})
+	if ev.Details != "" {
+		json.Unmarshal([]byte(ev.Details), &details)
+	}
+	return gin.H{
+		"id":       ev.ID,
+		"type":     ev.Type,
+		"actor":    ev.Actor,
+		"target":   ev.Target,
+		"clientIp": ev.ClientIP,
+		"outcome":  ev.Outcome,
+		"details":  details,
+		"date":     ev.Date,
+	}
+}
+
+//auditEvent records a security event of a request. Actor is who did it (an email, 'master' for master token holders or 'system') and target is what was affected (usually an email)
+func auditEvent(c *gin.Context, eventType string, actor string, target string, success bool, details map[string]interface{}) {
+	realm := defaultRealm
+	r, exists := c.Get("realm")
+	if exists {
+		realm = r.(*realmInfo).Name
+	}
+	saveAuditEvent(realm, eventType, actor, target, c.ClientIP(), success, details)
+}
+
+func saveAuditEvent(realm string, eventType string, actor string, target string, clientIP string, success bool, details map[string]interface{}) {
+	ev := AuditEvent{
+		ID:       uuid.New().String(),
+		Realm:    realm,
+		Type:     eventType,
+		Actor:    strings.ToLower(actor),
+		Target:   strings.ToLower(target),
+		ClientIP: clientIP,
+		Outcome:  "success",
+		Date:     time.Now(),
+	}
+	if !success {
+		ev.Outcome = "failure"
+	}
+	if len(details) > 0 {
+		d, err := json.Marshal(details)
+		if err == nil {
+			ev.Details = string(d)
+		}
+	}
+	err := db.Create(&ev).Error
+	if err != nil {
+		logrus.Warnf("Couldn't save audit event %s of %s. err=%s", eventType, target, err)
+	}
+}
+
+//auditAdminActions records every change made with master tokens (and data exports) after the request is handled, including the ones rejected for invalid tokens
+func auditAdminActions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		ppath := c.FullPath()
+		if !strings.Contains(ppath, "/admin/") || (c.Request.Method == "GET" && !strings.HasSuffix(ppath, "/export")) {
+			return
+		}
+
+		details := map[string]interface{}{"method": c.Request.Method, "path": ppath, "status": c.Writer.Status()}
+		target := ""
+		for _, p := range c.Params {
+			details[p.Key] = p.Value
+			if target == "" && p.Key != "realm" {
+				target = p.Value
+			}
+		}
+		//realm administration routes are not realm scoped. Their events go to the managed realm, except for deletions, whose events would be deleted along with the realm
+		realm := defaultRealm
+		r, exists := c.Get("realm")
+		if exists {
+			realm = r.(*realmInfo).Name
+		} else if c.Param("name") != "" && c.Request.Method != "DELETE" {
+			realm = c.Param("name")
+		}
+		saveAuditEvent(realm, "admin.action", "master", target, c.ClientIP(), c.Writer.Status() < 400, details)
+	}
+}
+
+//pseudonymizeAuditEvents replaces every email a user had (as actor, target or in details) by 'deleted-[user id]', so audit events outlive the account erasure without its personal data
+func pseudonymizeAuditEvents(tx *gorm.DB, u *User) error {
+	ecs := make([]EmailChange, 0)
+	err := tx.Find(&ecs, "user_id = ?", u.ID).Error
+	if err != nil {
+		return err
+	}
+	emails := []string{u.Email}
+	for _, ec := range ecs {
+		for _, e := range []string{ec.OldEmail, ec.NewEmail} {
+			if !isOneOf(e, emails) {
+				emails = append(emails, e)
+			}
+		}
+	}
+
+	pseudonym := fmt.Sprintf("deleted-%s", u.ID)
+	jsonPseudonym, _ := json.Marshal(pseudonym)
+	for _, e := range emails {
+		err = tx.Model(&AuditEvent{}).Where("realm = ? AND actor = ?", u.Realm, e).UpdateColumn("actor", pseudonym).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&AuditEvent{}).Where("realm = ? AND target = ?", u.Realm, e).UpdateColumn("target", pseudonym).Error
+		if err != nil {
+			return err
+		}
+		jsonEmail, _ := json.Marshal(e)
+		err = tx.Model(&AuditEvent{}).Where("realm = ? AND details LIKE ? ESCAPE '!'", u.Realm, jsonValueLikePattern(e)).UpdateColumn("details", gorm.Expr("REPLACE(details, ?, ?)", string(jsonEmail), string(jsonPseudonym))).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//runAuditRetentionWorker removes audit events older than the retention period every hour
+func runAuditRetentionWorker() {
+	for {
+		minDate := time.Now().Add(-time.Duration(opt.auditRetentionDays) * 24 * time.Hour)
+		db1 := db.Delete(AuditEvent{}, "date < ?", minDate)
+		if db1.Error != nil {
+			logrus.Warnf("Couldn't remove old audit events. err=%s", db1.Error)
+		} else if db1.RowsAffected > 0 {
+			logrus.Infof("%d audit events older than %d days removed", db1.RowsAffected, opt.auditRetentionDays)
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
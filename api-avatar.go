@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+//avatarMaxPixels avoids decoding huge images (decompression bombs)
+const avatarMaxPixels = 50 * 1000 * 1000
+
+var avatarContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+func (h *HTTPServer) setupAvatarHandlers(rg *gin.RouterGroup) {
+	rg.PUT("/user/:email/avatar", avatarPut())
+	rg.DELETE("/user/:email/avatar", avatarDelete())
+	rg.GET("/avatar/:id", avatarGet())
+}
+
+func avatarPut() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("avatarPut email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		var body io.Reader = c.Request.Body
+		if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+			fh, err := c.FormFile("avatar")
+			if err != nil {
+				c.JSON(460, gin.H{"message": "Form field 'avatar' not found"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+				return
+			}
+			f, err := fh.Open()
+			if err != nil {
+				c.JSON(460, gin.H{"message": "Invalid image"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+				return
+			}
+			defer f.Close()
+			body = f
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(body, int64(opt.avatarMaxSizeBytes)+1))
+		if err != nil {
+			c.JSON(500, gin.H{"message": fmt.Sprintf("Couldn't read body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if len(data) > opt.avatarMaxSizeBytes {
+			c.JSON(413, gin.H{"message": fmt.Sprintf("Image must have at most %d bytes", opt.avatarMaxSizeBytes)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "413").Inc()
+			return
+		}
+
+		avatar, err := processAvatarImage(data)
+		if err != nil {
+			logrus.Debugf("Invalid avatar image for %s. err=%s", email, err)
+			c.JSON(460, gin.H{"message": fmt.Sprintf("Invalid image. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		err = storeAvatar(r, u, avatar)
+		if err != nil {
+			logrus.Warnf("Error storing avatar of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Avatar of %s updated", email)
+		c.JSON(200, gin.H{"avatarUrl": avatarURL(c, u)})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func avatarDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("avatarDelete email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		if u.AvatarKey == "" {
+			c.JSON(404, gin.H{"message": "Avatar not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		err := db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("avatar_key", "").Error
+		if err != nil {
+			logrus.Warnf("Error removing avatar of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		err = blobs.Delete(u.AvatarKey)
+		if err != nil {
+			logrus.Warnf("Couldn't delete avatar blob %s. err=%s", u.AvatarKey, err)
+		}
+
+		logrus.Infof("Avatar of %s removed", email)
+		c.JSON(200, gin.H{"message": "Avatar removed"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//avatarGet serves avatars by user id without authentication, so they can be used directly in html img tags
+func avatarGet() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		id := c.Param("id")
+
+		var u User
+		err := db.First(&u, "realm = ? AND id = ? AND enabled = 1", r.Name, id).Error
+		if err != nil || u.AvatarKey == "" {
+			c.JSON(404, gin.H{"message": "Avatar not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		etag := fmt.Sprintf("\"%s\"", u.AvatarKey[strings.LastIndex(u.AvatarKey, "/")+1:])
+		c.Header("Cache-Control", "public, max-age=3600")
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(304)
+			invocationCounter.WithLabelValues(pmethod, ppath, "304").Inc()
+			return
+		}
+
+		data, contentType, err := blobs.Get(u.AvatarKey)
+		if err == errBlobNotFound {
+			c.JSON(404, gin.H{"message": "Avatar not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		if err != nil {
+			logrus.Warnf("Error loading avatar blob %s. err=%s", u.AvatarKey, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.Data(200, contentType, data)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//avatarURL returns the path in which the user avatar is served. Empty if the user has no avatar
+func avatarURL(c *gin.Context, u *User) string {
+	if u.AvatarKey == "" {
+		return ""
+	}
+	if c.Param("realm") != "" {
+		return fmt.Sprintf("/realm/%s/avatar/%s", c.Param("realm"), u.ID)
+	}
+	return fmt.Sprintf("/avatar/%s", u.ID)
+}
+
+//storeAvatar saves a processed avatar image and replaces the previous one of the user
+func storeAvatar(r *realmInfo, u *User, avatar []byte) error {
+	key := fmt.Sprintf("avatars/%s/%s/%s.png", r.Name, u.ID, uuid.New().String())
+	err := blobs.Put(key, avatar, "image/png")
+	if err != nil {
+		return err
+	}
+	err = db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("avatar_key", key).Error
+	if err != nil {
+		blobs.Delete(key)
+		return err
+	}
+	if u.AvatarKey != "" {
+		err = blobs.Delete(u.AvatarKey)
+		if err != nil {
+			logrus.Warnf("Couldn't delete previous avatar blob %s. err=%s", u.AvatarKey, err)
+		}
+	}
+	u.AvatarKey = key
+	return nil
+}
+
+//importAvatar downloads a social profile picture and stores it as the user avatar. Errors are only logged because the login must not fail because of it
+func importAvatar(r *realmInfo, u *User, pictureURL string) {
+	logrus.Debugf("Importing avatar of %s from %s", u.Email, pictureURL)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(pictureURL)
+	if err != nil {
+		logrus.Infof("Couldn't download profile picture of %s. err=%s", u.Email, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		logrus.Infof("Couldn't download profile picture of %s. status=%d", u.Email, resp.StatusCode)
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(opt.avatarMaxSizeBytes)+1))
+	if err != nil || len(data) > opt.avatarMaxSizeBytes {
+		logrus.Infof("Couldn't read profile picture of %s. size=%d err=%v", u.Email, len(data), err)
+		return
+	}
+	avatar, err := processAvatarImage(data)
+	if err != nil {
+		logrus.Infof("Invalid profile picture for %s. err=%s", u.Email, err)
+		return
+	}
+	err = storeAvatar(r, u, avatar)
+	if err != nil {
+		logrus.Warnf("Error storing imported avatar of %s. err=%s", u.Email, err)
+		return
+	}
+	logrus.Infof("Avatar of %s imported from social profile", u.Email)
+}
+
+//processAvatarImage validates an uploaded image, crops it to a centered square and resizes it to --avatar-size-pixels. Result is a PNG image
+func processAvatarImage(data []byte) ([]byte, error) {
+	contentType := http.DetectContentType(data)
+	if !isOneOf(contentType, avatarContentTypes) {
+		return nil, fmt.Errorf("Unsupported image type %s. Use one of %s", contentType, strings.Join(avatarContentTypes, ", "))
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > avatarMaxPixels {
+		return nil, fmt.Errorf("Image is too large (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x := b.Min.X + (b.Dx()-side)/2
+	y := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x, y, x+side, y+side)
+
+	size := opt.avatarSizePixels
+	if side < size {
+		size = side
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, resizeImage(img, crop, size))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//resizeImage scales the source rectangle of an image to a size x size image by averaging the source pixels covered by each destination pixel (box filter)
+func resizeImage(src image.Image, rect image.Rectangle, size int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	side := rect.Dx()
+	for y := 0; y < size; y++ {
+		sy0 := rect.Min.Y + y*side/size
+		sy1 := rect.Min.Y + (y+1)*side/size
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0 := rect.Min.X + x*side/size
+			sx1 := rect.Min.X + (x+1)*side/size
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			//average of alpha premultiplied values, converted back to non premultiplied
+			c := color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)}
+			dst.Set(x, y, c)
+		}
+	}
+	return dst
+}
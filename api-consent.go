@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupConsentHandlers(rg *gin.RouterGroup) {
+	rg.POST("/admin/consent-document/:name", adminConsentDocumentCreate())
+	rg.GET("/admin/consent-document", adminConsentDocumentList())
+	rg.GET("/consent-document", consentDocumentList())
+	rg.POST("/user/:email/consent", userConsentAccept())
+}
+
+func adminConsentDocumentCreate() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		name := c.Param("name")
+		logrus.Debugf("adminConsentDocumentCreate name=%s", name)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+		m["name"] = name
+
+		if !validateField(m, "name", "^[a-z0-9-]{2,40}$") {
+			c.JSON(455, gin.H{"message": "Invalid name"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		if !validateField(m, "url", "^https?://.{1,240}$") {
+			c.JSON(460, gin.H{"message": "Invalid url"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		doc := ConsentDocument{
+			ID:           uuid.New().String(),
+			Realm:        r.Name,
+			Name:         name,
+			URL:          m["url"],
+			Mandatory:    m["mandatory"] == "true",
+			PublishDate:  time.Now(),
+			CreationDate: time.Now(),
+		}
+		pd, exists := m["publishDate"]
+		if exists {
+			doc.PublishDate, err = time.Parse(time.RFC3339, pd)
+			if err != nil {
+				c.JSON(465, gin.H{"message": "Invalid publishDate. Use RFC3339 format"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var last ConsentDocument
+			db1 := tx.Order("version DESC").First(&last, "realm = ? AND name = ?", r.Name, name)
+			if db1.Error != nil && !db1.RecordNotFound() {
+				return db1.Error
+			}
+			doc.Version = last.Version + 1
+			return tx.Create(&doc).Error
+		})
+		if err != nil {
+			logrus.Warnf("Error creating consent document %s. err=%s", name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Consent document %s version %d created (mandatory=%t)", name, doc.Version, doc.Mandatory)
+		c.JSON(201, doc)
+		invocationCounter.WithLabelValues(pmethod, ppath, "201").Inc()
+	}
+}
+
+func adminConsentDocumentList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		docs := make([]ConsentDocument, 0)
+		err = db.Order("name, version").Find(&docs, "realm = ?", r.Name).Error
+		if err != nil {
+			logrus.Warnf("Error listing consent documents. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, docs)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//consentDocumentList returns the current version of each consent document. Used in signup forms
+func consentDocumentList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		current, _, err := loadCurrentConsentDocuments(r)
+		if err != nil {
+			logrus.Warnf("Error listing consent documents. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, current)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//userConsentAccept records the acceptance of consent documents. Accepts access tokens or the consent token returned by POST /token when a consent is required
+func userConsentAccept() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("userConsentAccept email=%s", email)
+
+		claims, err := loadAndValidateToken(r, c.Request, "", email)
+		if err != nil || (!claimEquals(claims, "typ", "access") && !claimEquals(claims, "typ", "consent")) {
+			c.JSON(450, gin.H{"message": "Invalid token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		err = db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email).Error
+		if err != nil {
+			c.JSON(455, gin.H{"message": "Invalid account"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		docs, valid := processParseConsents(r, m["consents"], c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		if len(docs) == 0 {
+			c.JSON(480, gin.H{"message": "Invalid consents"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "480").Inc()
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return recordConsents(tx, &u, docs, c.ClientIP())
+		})
+		if err != nil {
+			logrus.Warnf("Error recording consents of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		accepted, err := loadAcceptedConsents(u.ID)
+		if err != nil {
+			logrus.Warnf("Error loading consents of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Consents of %s recorded", email)
+		c.JSON(200, gin.H{"consents": accepted})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//processParseConsents parses accepted document versions in the format 'terms:3,privacy:2'. Only published versions can be accepted
+func processParseConsents(r *realmInfo, consents string, c *gin.Context, pmethod string, ppath string) ([]ConsentDocument, bool) {
+	docs := make([]ConsentDocument, 0)
+	for _, cs := range strings.Split(consents, ",") {
+		cs = strings.TrimSpace(cs)
+		if cs == "" {
+			continue
+		}
+		parts := strings.Split(cs, ":")
+		version, err := strconv.Atoi(parts[len(parts)-1])
+		if len(parts) != 2 || err != nil {
+			c.JSON(480, gin.H{"message": fmt.Sprintf("Invalid consent '%s'. Use 'document:version'", cs)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "480").Inc()
+			return nil, false
+		}
+		var doc ConsentDocument
+		db1 := db.First(&doc, "realm = ? AND name = ? AND version = ? AND publish_date <= ?", r.Name, parts[0], version, time.Now())
+		if db1.RecordNotFound() {
+			c.JSON(480, gin.H{"message": fmt.Sprintf("Consent document '%s' not found", cs)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "480").Inc()
+			return nil, false
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error loading consent document %s. err=%s", cs, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return nil, false
+		}
+		docs = append(docs, doc)
+	}
+	return docs, true
+}
+
+func recordConsents(tx *gorm.DB, u *User, docs []ConsentDocument, clientIP string) error {
+	for _, doc := range docs {
+		err := tx.Create(&Consent{
+			ID:           uuid.New().String(),
+			Realm:        u.Realm,
+			UserID:       u.ID,
+			DocumentName: doc.Name,
+			Version:      doc.Version,
+			AcceptDate:   time.Now(),
+			ClientIP:     clientIP,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//loadCurrentConsentDocuments returns the latest published version of each document along with the latest published mandatory version of each one
+func loadCurrentConsentDocuments(r *realmInfo) (current []ConsentDocument, mandatory map[string]int, err error) {
+	docs := make([]ConsentDocument, 0)
+	err = db.Order("name, version").Find(&docs, "realm = ? AND publish_date <= ?", r.Name, time.Now()).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	latest := make(map[string]ConsentDocument)
+	mandatory = make(map[string]int)
+	for _, doc := range docs {
+		latest[doc.Name] = doc
+		if doc.Mandatory {
+			mandatory[doc.Name] = doc.Version
+		}
+	}
+	current = make([]ConsentDocument, 0)
+	for _, doc := range latest {
+		current = append(current, doc)
+	}
+	sort.Slice(current, func(i, j int) bool { return current[i].Name < current[j].Name })
+	return current, mandatory, nil
+}
+
+//loadAcceptedConsents returns the latest accepted version of each document by the user
+func loadAcceptedConsents(userID string) (map[string]int, error) {
+	consents := make([]Consent, 0)
+	err := db.Find(&consents, "user_id = ?", userID).Error
+	if err != nil {
+		return nil, err
+	}
+	accepted := make(map[string]int)
+	for _, cs := range consents {
+		if cs.Version > accepted[cs.DocumentName] {
+			accepted[cs.DocumentName] = cs.Version
+		}
+	}
+	return accepted, nil
+}
+
+//pendingConsents returns the current version of documents that the user must accept because a newer mandatory version was published
+func pendingConsents(r *realmInfo, accepted map[string]int) ([]ConsentDocument, error) {
+	current, mandatory, err := loadCurrentConsentDocuments(r)
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]ConsentDocument, 0)
+	for _, doc := range current {
+		v, exists := mandatory[doc.Name]
+		if exists && accepted[doc.Name] < v {
+			pending = append(pending, doc)
+		}
+	}
+	return pending, nil
+}
+
+//processOutputConsentRequired responds with the documents the user must accept and a short lived token for accepting them
+func processOutputConsentRequired(r *realmInfo, u *User, pending []ConsentDocument, authType string, c *gin.Context, pmethod string, ppath string) {
+	_, consentTokenString, err := createJWTToken(r, u.Email, opt.validationTokenExpirationMinutes, "consent", authType, nil)
+	if err != nil {
+		logrus.Warnf("Error creating consent token for %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	c.JSON(480, gin.H{"message": "Consent required", "documents": pending, "consentToken": consentTokenString})
+	invocationCounter.WithLabelValues(pmethod, ppath, "480").Inc()
+}
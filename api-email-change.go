@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupEmailChangeHandlers(rg *gin.RouterGroup) {
+	rg.POST("/user/:email/email-change-request", emailChangeRequest())
+	rg.POST("/user/:email/email-change-confirm", emailChangeConfirm())
+	rg.POST("/user/:email/email-change-undo", emailChangeUndo())
+}
+
+func emailChangeRequest() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("emailChangeRequest email=%s", email)
+
+		subject, htmlBody, ok1 := r.mailTemplate("email-change")
+		notificationSubject, notificationHTMLBody, ok2 := r.mailTemplate("email-change-notification")
+		if !ok1 || !ok2 {
+			c.JSON(400, gin.H{"message": "Email change disabled"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		_, err := loadAndValidateToken(r, c.Request, "access", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid access token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		err = db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email).Error
+		if err != nil {
+			c.JSON(455, gin.H{"message": "Invalid account"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		//accounts created by social logins have no password
+		if u.PasswordHash != "" {
+			if !validUserPassword(&u, m["password"]) {
+				c.JSON(470, gin.H{"message": "Invalid current password"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+				return
+			}
+		}
+
+		newEmail := strings.ToLower(m["newEmail"])
+		m["newEmail"] = newEmail
+		if !validateField(m, "newEmail", emailValidationRegex) || newEmail == email {
+			c.JSON(460, gin.H{"message": "Invalid new email"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		if !db.First(&User{}, "realm = ? AND email = ?", r.Name, newEmail).RecordNotFound() {
+			c.JSON(465, gin.H{"message": "Email already registered"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		claims, confirmationTokenString, err := createJWTToken(r, newEmail, opt.validationTokenExpirationMinutes, "email-change", "password", nil)
+		if err != nil {
+			logrus.Warnf("Error creating email change token for email=%s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		ec := EmailChange{
+			ID:           claims["jti"].(string),
+			Realm:        r.Name,
+			UserID:       u.ID,
+			OldEmail:     email,
+			NewEmail:     newEmail,
+			CreationDate: time.Now(),
+		}
+		_, undoTokenString, err := createJWTToken(r, email, opt.emailChangeUndoExpirationMinutes, "email-change-undo", "password", jwt.MapClaims{"change_id": ec.ID})
+		if err != nil {
+			logrus.Warnf("Error creating email change undo token for email=%s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		err = db.Create(&ec).Error
+		if err != nil {
+			logrus.Warnf("Error saving email change for email=%s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		htmlBody = renderMailTemplate(htmlBody,
+			"EMAIL_CHANGE_TOKEN", confirmationTokenString,
+			"NEW_EMAIL", newEmail,
+			"EMAIL", email,
+			"DISPLAY_NAME", u.Name)
+		err = sendMail(r, subject, htmlBody, newEmail, u.Name)
+		if err != nil {
+			logrus.Warnf("Couldn't send email change confirmation to %s (%s). err=%s", newEmail, subject, err)
+			mailCounter.WithLabelValues("POST", "email-change", "500").Inc()
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		mailCounter.WithLabelValues("POST", "email-change", "202").Inc()
+
+		notificationHTMLBody = renderMailTemplate(notificationHTMLBody,
+			"EMAIL_CHANGE_UNDO_TOKEN", undoTokenString,
+			"NEW_EMAIL", newEmail,
+			"EMAIL", email,
+			"DISPLAY_NAME", u.Name)
+		err = sendMail(r, notificationSubject, notificationHTMLBody, email, u.Name)
+		if err != nil {
+			logrus.Warnf("Couldn't send email change notification to %s (%s). err=%s", email, notificationSubject, err)
+			mailCounter.WithLabelValues("POST", "email-change-notification", "500").Inc()
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		mailCounter.WithLabelValues("POST", "email-change-notification", "202").Inc()
+
+		logrus.Infof("Email change from %s to %s requested", email, newEmail)
+		if opt.mailTokensTests == "true" {
+			logrus.Warnf("ADDING EMAIL CHANGE TOKENS TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
+			c.Header("Test-Token", confirmationTokenString)
+			c.Header("Test-Undo-Token", undoTokenString)
+		}
+		c.JSON(202, gin.H{"message": "Confirmation sent to new email"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+	}
+}
+
+func emailChangeConfirm() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("emailChangeConfirm email=%s", email)
+
+		claims, err := loadAndValidateToken(r, c.Request, "email-change", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid email change token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var ec EmailChange
+		db1 := db.First(&ec, "realm = ? AND id = ? AND new_email = ? AND confirmation_date IS NULL AND undo_date IS NULL", r.Name, claims["jti"], email)
+		if db1.RecordNotFound() {
+			c.JSON(450, gin.H{"message": "Invalid email change token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting email change for %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		if !processChangeUserEmail(r, &ec, ec.OldEmail, ec.NewEmail, "confirmation_date", nil, c, pmethod, ppath) {
+			return
+		}
+
+		logrus.Infof("Email of user %s changed from %s to %s", ec.UserID, ec.OldEmail, ec.NewEmail)
+		auditEvent(c, "user.email-change", ec.NewEmail, ec.OldEmail, true, map[string]interface{}{"newEmail": ec.NewEmail})
+		emitWebhookEvent(r.Name, "user.email-changed", map[string]interface{}{"id": ec.UserID, "email": ec.NewEmail, "oldEmail": ec.OldEmail})
+		c.JSON(200, gin.H{"message": "Email changed"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func emailChangeUndo() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("emailChangeUndo email=%s", email)
+
+		claims, err := loadAndValidateToken(r, c.Request, "email-change-undo", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid email change undo token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var ec EmailChange
+		db1 := db.First(&ec, "realm = ? AND id = ? AND old_email = ? AND undo_date IS NULL", r.Name, claims["change_id"], email)
+		if db1.RecordNotFound() {
+			c.JSON(450, gin.H{"message": "Invalid email change undo token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting email change for %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		var revokedSessions int64
+		if ec.ConfirmationDate == nil {
+			//change not confirmed yet. Just cancel it
+			err = db.Model(&ec).UpdateColumn("undo_date", time.Now()).Error
+			if err != nil {
+				logrus.Warnf("Error cancelling email change %s. err=%s", ec.ID, err)
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+		} else {
+			//whoever confirmed the change may have taken over the account. Sign out every session and require a password reset
+			secureAccount := func(tx *gorm.DB, u *User) error {
+				tx1 := tx.Model(&Session{}).Where("user_id = ? AND revocation_date IS NULL", u.ID).UpdateColumn("revocation_date", time.Now())
+				if tx1.Error != nil {
+					return tx1.Error
+				}
+				revokedSessions = tx1.RowsAffected
+				return tx.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("password_reset_required", true).Error
+			}
+			if !processChangeUserEmail(r, &ec, ec.NewEmail, ec.OldEmail, "undo_date", secureAccount, c, pmethod, ppath) {
+				return
+			}
+		}
+
+		logrus.Infof("Email change of user %s from %s to %s undone", ec.UserID, ec.OldEmail, ec.NewEmail)
+		details := map[string]interface{}{"oldEmail": ec.OldEmail}
+		if ec.ConfirmationDate != nil {
+			details["passwordResetRequired"] = true
+			auditEvent(c, "token.revoke", ec.OldEmail, ec.OldEmail, true, map[string]interface{}{"sessions": revokedSessions})
+		}
+		auditEvent(c, "user.email-change-undo", ec.OldEmail, ec.NewEmail, true, details)
+		emitWebhookEvent(r.Name, "user.email-changed", map[string]interface{}{"id": ec.UserID, "email": ec.OldEmail, "oldEmail": ec.NewEmail})
+		c.JSON(200, gin.H{"message": "Email change undone"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//processChangeUserEmail moves the user from one email to another and sets the email change date column. onChange, when set, runs in the same transaction
+func processChangeUserEmail(r *realmInfo, ec *EmailChange, fromEmail string, toEmail string, dateColumn string, onChange func(tx *gorm.DB, u *User) error, c *gin.Context, pmethod string, ppath string) bool {
+	if !db.First(&User{}, "realm = ? AND email = ?", r.Name, toEmail).RecordNotFound() {
+		c.JSON(465, gin.H{"message": "Email already registered"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+		return false
+	}
+
+	var u User
+	db1 := db.First(&u, "realm = ? AND id = ? AND email = ?", r.Name, ec.UserID, fromEmail)
+	if db1.RecordNotFound() {
+		c.JSON(404, gin.H{"message": "Account not found"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+		return false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error getting user %s. err=%s", ec.UserID, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&u).UpdateColumn("email", toEmail).Error
+		if err != nil {
+			return err
+		}
+		err = saveOutboxEvent(tx, r.Name, "user.email-changed", map[string]interface{}{"id": u.ID, "email": toEmail, "oldEmail": fromEmail})
+		if err != nil {
+			return err
+		}
+		if onChange != nil {
+			err = onChange(tx, &u)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(ec).UpdateColumn(dateColumn, time.Now()).Error
+	})
+	if err != nil {
+		logrus.Warnf("Error changing email of user %s from %s to %s. err=%s", ec.UserID, fromEmail, toEmail, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+	return true
+}
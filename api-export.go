@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+//userExportSections are the parts of the user data export. Each one returns everything stored about the user in a domain, never including secrets (password hashes, codes, provider tokens)
+var userExportSections = []struct {
+	name   string
+	export func(c *gin.Context, u *User) (interface{}, error)
+}{
+	{"user", exportUserRow},
+	{"organizations", exportMemberships},
+	{"invitations", exportInvitations},
+	{"emailChanges", exportEmailChanges},
+	{"consents", exportConsents},
+	{"sessions", exportSessions},
+	{"loginHistory", exportLoginHistory},
+	{"auditEvents", exportAuditEvents},
+}
+
+func (h *HTTPServer) setupExportHandlers(rg *gin.RouterGroup) {
+	rg.GET("/user/:email/export", userExport())
+	rg.GET("/admin/user/:email/export", adminUserExport())
+}
+
+func userExport() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("userExport email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		processOutputUserExport(u, c, pmethod, ppath)
+	}
+}
+
+func adminUserExport() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminUserExport email=%s", email)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
+		if db1.RecordNotFound() {
+			c.JSON(404, gin.H{"message": "User not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error loading user %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		processOutputUserExport(&u, c, pmethod, ppath)
+	}
+}
+
+func processOutputUserExport(u *User, c *gin.Context, pmethod string, ppath string) {
+	export := gin.H{
+		"exportDate": time.Now().Format(time.RFC3339),
+		"realm":      u.Realm,
+	}
+	for _, s := range userExportSections {
+		data, err := s.export(c, u)
+		if err != nil {
+			logrus.Warnf("Error exporting %s of user %s. err=%s", s.name, u.ID, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		export[s.name] = data
+	}
+
+	logrus.Infof("Data of user %s exported", u.ID)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"userme-export-%s.json\"", u.ID))
+	c.JSON(200, export)
+	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+}
+
+func exportUserRow(c *gin.Context, u *User) (interface{}, error) {
+	data := profileResponse(c, u)
+	data["realm"] = u.Realm
+	data["passwordDefined"] = u.PasswordHash != ""
+	data["passwordDate"] = u.PasswordDate
+	data["passwordValidUntil"] = u.PasswordValidUntil
+	data["passwordResetRequired"] = u.PasswordResetRequired
+	data["passwordExpirationMailDate"] = u.PasswordExpirationMailDate
+	data["activationDate"] = u.ActivationDate
+	data["approvalStatus"] = u.ApprovalStatus
+	data["mailVerifiedDate"] = u.MailVerifiedDate
+	data["activationMailDate"] = u.ActivationMailDate
+	data["wrongPasswordCount"] = u.WrongPasswordCount
+	data["wrongPasswordDate"] = u.WrongPasswordDate
+	data["lastTokenType"] = u.LastTokenType
+	data["lastTokenDate"] = u.LastTokenDate
+	data["enabled"] = u.Enabled == 1
+	data["deletionRequestDate"] = u.DeletionRequestDate
+	data["deletionDate"] = u.DeletionDate
+	return data, nil
+}
+
+func exportMemberships(c *gin.Context, u *User) (interface{}, error) {
+	type membership struct {
+		OrganizationID string    `json:"organizationId"`
+		Name           string    `json:"name"`
+		Role           string    `json:"role"`
+		Scopes         string    `json:"scopes"`
+		CreationDate   time.Time `json:"creationDate"`
+	}
+	ms := make([]membership, 0)
+	err := db.Table("memberships").
+		Select("memberships.organization_id, organizations.name, memberships.role, memberships.scopes, memberships.creation_date").
+		Joins("JOIN organizations ON organizations.id = memberships.organization_id").
+		Where("memberships.user_id = ?", u.ID).
+		Order("organizations.name").
+		Scan(&ms).Error
+	return ms, err
+}
+
+func exportInvitations(c *gin.Context, u *User) (interface{}, error) {
+	invs := make([]Invitation, 0)
+	err := db.Order("creation_date").Find(&invs, "realm = ? AND (email = ? OR invited_by = ?)", u.Realm, u.Email, u.ID).Error
+	return invs, err
+}
+
+func exportEmailChanges(c *gin.Context, u *User) (interface{}, error) {
+	ecs := make([]EmailChange, 0)
+	err := db.Order("creation_date").Find(&ecs, "user_id = ?", u.ID).Error
+	return ecs, err
+}
+
+func exportConsents(c *gin.Context, u *User) (interface{}, error) {
+	cs := make([]Consent, 0)
+	err := db.Order("accept_date").Find(&cs, "user_id = ?", u.ID).Error
+	return cs, err
+}
+
+func exportSessions(c *gin.Context, u *User) (interface{}, error) {
+	ss := make([]Session, 0)
+	err := db.Order("creation_date").Find(&ss, "user_id = ?", u.ID).Error
+	return ss, err
+}
+
+func exportLoginHistory(c *gin.Context, u *User) (interface{}, error) {
+	las := make([]LoginAttempt, 0)
+	err := db.Order("date").Find(&las, "user_id = ?", u.ID).Error
+	return las, err
+}
+
+//exportAuditEvents returns the audit events done by or about the user
+func exportAuditEvents(c *gin.Context, u *User) (interface{}, error) {
+	events := make([]AuditEvent, 0)
+	ids := []string{strings.ToLower(u.Email), u.ID}
+	err := db.Order("date").Find(&events, "realm = ? AND (actor IN (?) OR target IN (?))", u.Realm, ids, ids).Error
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]gin.H, 0)
+	for _, ev := range events {
+		resp = append(resp, auditEventResponse(ev))
+	}
+	return resp, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupInvitationHandlers(rg *gin.RouterGroup) {
+	rg.POST("/admin/invitation/:email", adminInvitationCreate())
+	rg.GET("/admin/invitation", adminInvitationList())
+	rg.DELETE("/admin/invitation/:id", adminInvitationDelete())
+	rg.POST("/org/:org/invitation/:email", orgInvitationCreate())
+	rg.POST("/user/:email/invitation-accept", invitationAccept())
+}
+
+func adminInvitationCreate() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminInvitationCreate email=%s", email)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		var o *Organization
+		orgID, exists := m["organizationId"]
+		if exists && orgID != "" {
+			var success bool
+			o, success = processLoadOrganization(r, orgID, c, pmethod, ppath)
+			if !success {
+				return
+			}
+		}
+
+		processSendInvitation(r, email, o, m, "master", c, pmethod, ppath)
+	}
+}
+
+func orgInvitationCreate() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("orgInvitationCreate email=%s", email)
+
+		actor, actorRole, success := processValidateOrgManager(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		o, success := processLoadOrganization(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err := json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		//only admins may pre-assign user roles and membership scopes, as scopes are appended to access tokens
+		delete(m, "roles")
+		if actor != "master" {
+			delete(m, "scopes")
+			if (m["role"] == "owner" || m["role"] == "admin") && actorRole != "owner" {
+				c.JSON(465, gin.H{"message": "Only organization owners can invite owners and admins"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+
+		processSendInvitation(r, email, o, m, actor, c, pmethod, ppath)
+	}
+}
+
+func adminInvitationList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		invs := make([]Invitation, 0)
+		err = db.Order("creation_date desc").Find(&invs, "realm = ? AND accepted_date IS NULL AND expiration_date > ?", r.Name, time.Now()).Error
+		if err != nil {
+			logrus.Warnf("Error listing invitations. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, invs)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminInvitationDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		db1 := db.Delete(Invitation{}, "realm = ? AND id = ? AND accepted_date IS NULL", r.Name, c.Param("id"))
+		if db1.Error != nil {
+			logrus.Warnf("Error deleting invitation %s. err=%s", c.Param("id"), db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if db1.RowsAffected == 0 {
+			c.JSON(404, gin.H{"message": "Pending invitation not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		logrus.Infof("Invitation %s revoked", c.Param("id"))
+		c.JSON(200, gin.H{"message": "Invitation revoked"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//invitationAccept is used by existing users. New users accept invitations during signup (PUT /user/:email)
+func invitationAccept() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("invitationAccept email=%s", email)
+
+		inv, valid, err := loadInvitationFromToken(r, c.Request, email)
+		if err != nil {
+			logrus.Warnf("Error getting invitation for %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if !valid {
+			c.JSON(450, gin.H{"message": "Invalid invitation token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		db1 := db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email)
+		if db1.RecordNotFound() {
+			c.JSON(404, gin.H{"message": "Account not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting user %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return applyInvitation(tx, inv, &u)
+		})
+		if err != nil {
+			logrus.Warnf("Error accepting invitation %s for %s. err=%s", inv.ID, email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("User %s accepted invitation %s", email, inv.ID)
+		c.JSON(200, gin.H{"message": "Invitation accepted", "organizationId": inv.OrganizationID, "role": inv.Role})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//processSendInvitation registers an invitation and mails its token. Organization is optional
+func processSendInvitation(r *realmInfo, email string, o *Organization, m map[string]string, actor string, c *gin.Context, pmethod string, ppath string) {
+	subject, htmlBody, ok := r.mailTemplate("invitation")
+	if !ok {
+		c.JSON(400, gin.H{"message": "Invitations disabled"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+		return
+	}
+
+	m["email"] = email
+	valid := validateField(m, "email", emailValidationRegex)
+	if !valid {
+		c.JSON(460, gin.H{"message": "Invalid email"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+		return
+	}
+
+	inv := Invitation{
+		Realm:        r.Name,
+		Email:        email,
+		Roles:        m["roles"],
+		InvitedBy:    actor,
+		CreationDate: time.Now(),
+	}
+	customClaims := jwt.MapClaims{}
+	organizationName := r.MailFromName
+	if o != nil {
+		if !isOneOf(m["role"], orgRoles) {
+			c.JSON(455, gin.H{"message": "Invalid role"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+		inv.OrganizationID = o.ID
+		inv.Role = m["role"]
+		inv.Scopes = m["scopes"]
+		customClaims["org_id"] = o.ID
+		organizationName = o.Name
+	}
+
+	claims, invitationTokenString, err := createJWTToken(r, email, opt.invitationTokenExpirationMinutes, "invitation", "password", customClaims)
+	if err != nil {
+		logrus.Warnf("Error creating invitation token for email=%s. err=%s", email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	inv.ID = claims["jti"].(string)
+	inv.ExpirationDate = time.Unix(claims["exp"].(int64), 0)
+
+	err = db.Create(&inv).Error
+	if err != nil {
+		logrus.Warnf("Error saving invitation for email=%s. err=%s", email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+
+	htmlBody = renderMailTemplate(htmlBody,
+		"EMAIL", email,
+		"ORGANIZATION_NAME", organizationName,
+		"INVITATION_TOKEN", invitationTokenString)
+	err = sendMail(r, subject, htmlBody, email, email)
+	if err != nil {
+		logrus.Warnf("Couldn't send invitation email to %s (%s). err=%s", email, subject, err)
+		mailCounter.WithLabelValues("POST", "invitation", "500").Inc()
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	mailCounter.WithLabelValues("POST", "invitation", "202").Inc()
+
+	logrus.Infof("Invitation %s sent to %s by %s", inv.ID, email, actor)
+	if opt.mailTokensTests == "true" {
+		logrus.Warnf("ADDING INVITATION TOKEN TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
+		c.Header("Test-Token", invitationTokenString)
+	}
+	c.JSON(202, gin.H{"message": "Invitation sent to email", "id": inv.ID})
+	invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+}
+
+//loadInvitationFromToken returns the pending invitation related to the invitation token found in Authorization header
+func loadInvitationFromToken(r *realmInfo, req *http.Request, email string) (inv *Invitation, valid bool, err error) {
+	claims, err := loadAndValidateToken(r, req, "invitation", email)
+	if err != nil {
+		logrus.Debugf("Invalid invitation token. err=%s", err)
+		return nil, false, nil
+	}
+
+	var inv0 Invitation
+	db1 := db.First(&inv0, "realm = ? AND id = ? AND email = ? AND accepted_date IS NULL", r.Name, claims["jti"], email)
+	if db1.RecordNotFound() {
+		logrus.Debugf("Invitation %s not pending for %s", claims["jti"], email)
+		return nil, false, nil
+	}
+	if db1.Error != nil {
+		return nil, false, db1.Error
+	}
+	return &inv0, true, nil
+}
+
+//applyInvitation adds the user to the invited organization, assigns invited roles and marks the invitation as accepted
+func applyInvitation(tx *gorm.DB, inv *Invitation, u *User) error {
+	if inv.OrganizationID != "" {
+		err := tx.Save(&Membership{
+			OrganizationID: inv.OrganizationID,
+			UserID:         u.ID,
+			Role:           inv.Role,
+			Scopes:         inv.Scopes,
+			CreationDate:   time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	if inv.Roles != "" {
+		roles := mergeCommaSeparated(u.Roles, inv.Roles)
+		err := tx.Model(u).UpdateColumn("roles", roles).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(inv).UpdateColumn("accepted_date", time.Now()).Error
+}
+
+//mergeCommaSeparated joins two comma separated lists without duplicates
+func mergeCommaSeparated(list1 string, list2 string) string {
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, v := range strings.Split(list1+","+list2, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" && !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return strings.Join(result, ",")
+}
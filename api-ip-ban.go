@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+//bruteForceFailureReasons are the login failures counted against the client address. Failures of locked or disabled accounts are not guesses
+var bruteForceFailureReasons = []string{"invalid-credentials", "unknown-account"}
+
+var trustedProxies []*net.IPNet
+
+func (h *HTTPServer) setupIPBanHandlers(rg *gin.RouterGroup) {
+	rg.GET("/admin/ip-ban", adminIPBanList())
+	rg.DELETE("/admin/ip-ban/:id", adminIPBanClear())
+	rg.DELETE("/admin/ip-ban", adminIPBanClearAll())
+}
+
+func adminIPBanList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		bans := make([]IPBan, 0)
+		err = db.Order("creation_date DESC").Find(&bans, "realm = ? AND expiration_date > ?", r.Name, time.Now()).Error
+		if err != nil {
+			logrus.Warnf("Error listing ip bans. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, bans)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminIPBanClear() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		id := c.Param("id")
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		count, err := clearIPBans(r, "id = ?", id)
+		if err != nil {
+			logrus.Warnf("Error clearing ip ban %s. err=%s", id, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if count == 0 {
+			c.JSON(404, gin.H{"message": "Active ip ban not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		logrus.Infof("IP ban %s cleared", id)
+		c.JSON(200, gin.H{"message": "IP ban cleared"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminIPBanClearAll() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		count, err := clearIPBans(r, "1 = 1")
+		if err != nil {
+			logrus.Warnf("Error clearing ip bans. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("%d ip bans of realm %s cleared", count, r.Name)
+		c.JSON(200, gin.H{"message": "IP bans cleared", "count": count})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//clearIPBans ends active bans now. Ended bans are kept until the failures window is over, as failures before them are not counted again
+func clearIPBans(r *realmInfo, where string, args ...interface{}) (int64, error) {
+	args = append([]interface{}{r.Name, time.Now()}, args...)
+	db1 := db.Model(&IPBan{}).Where("realm = ? AND expiration_date > ? AND "+where, args...).UpdateColumn("expiration_date", time.Now())
+	return db1.RowsAffected, db1.Error
+}
+
+//processLoginThrottling rejects password logins from banned addresses and from addresses with too many recent failures (across all accounts) before their progressive delay is over.
+//Returns false if the login was rejected
+func processLoginThrottling(r *realmInfo, c *gin.Context, pmethod string, ppath string) bool {
+	ip := c.ClientIP()
+	for _, scope := range []string{"ip", "subnet"} {
+		address := ip
+		delayThreshold := opt.ipFailuresDelayThreshold
+		if scope == "subnet" {
+			address = clientNetwork(ip)
+			delayThreshold = opt.subnetFailuresDelayThreshold
+		}
+		ban, failures, lastFailure, err := loadAddressFailures(r, address)
+		if err != nil {
+			logrus.Warnf("Couldn't load login failures of %s. err=%s", address, err)
+			continue
+		}
+		if ban != nil {
+			logrus.Infof("Login from banned %s %s rejected", scope, address)
+			processOutputTooManyAttempts(ban.ExpirationDate, "ban", c, pmethod, ppath)
+			return false
+		}
+		if delayThreshold <= 0 || failures < delayThreshold {
+			continue
+		}
+		delay := time.Duration(float64(opt.ipFailuresDelaySeconds)*math.Pow(2, float64(failures-delayThreshold))) * time.Second
+		maxDelay := time.Duration(opt.ipFailuresWindowMinutes) * time.Minute
+		if delay > maxDelay || delay < 0 {
+			delay = maxDelay
+		}
+		if time.Now().Before(lastFailure.Add(delay)) {
+			logrus.Infof("Login delay enforced for %s %s. failures=%d delay=%s", scope, address, failures, delay)
+			processOutputTooManyAttempts(lastFailure.Add(delay), "delay", c, pmethod, ppath)
+			return false
+		}
+	}
+	return true
+}
+
+func processOutputTooManyAttempts(retryDate time.Time, reason string, c *gin.Context, pmethod string, ppath string) {
+	retryAfter := int(math.Ceil(time.Until(retryDate).Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	bruteForceRejectedCounter.WithLabelValues(reason).Inc()
+	c.Header("Retry-After", fmt.Sprintf("%d", retryAfter))
+	c.JSON(429, gin.H{"message": "Too many failed login attempts. Try again later"})
+	invocationCounter.WithLabelValues(pmethod, ppath, "429").Inc()
+}
+
+//loadAddressFailures returns the active ban of an address (ip or subnet) or, if not banned, how many login failures it had in the last --ip-failures-window-minutes.
+//Failures before the last ban ended are not counted
+func loadAddressFailures(r *realmInfo, address string) (*IPBan, int, time.Time, error) {
+	var ban IPBan
+	since := time.Now().Add(-time.Duration(opt.ipFailuresWindowMinutes) * time.Minute)
+	db1 := db.Order("expiration_date DESC").First(&ban, "realm = ? AND address = ?", r.Name, address)
+	if db1.Error != nil && !db1.RecordNotFound() {
+		return nil, 0, time.Time{}, db1.Error
+	}
+	if db1.Error == nil {
+		if ban.ExpirationDate.After(time.Now()) {
+			return &ban, 0, time.Time{}, nil
+		}
+		if ban.ExpirationDate.After(since) {
+			since = ban.ExpirationDate
+		}
+	}
+
+	column := "client_ip"
+	if strings.Contains(address, "/") {
+		column = "network"
+	}
+	failures := 0
+	query := db.Model(&LoginAttempt{}).Where("realm = ? AND "+column+" = ? AND date > ? AND reason IN (?)", r.Name, address, since, bruteForceFailureReasons)
+	err := query.Count(&failures).Error
+	if err != nil || failures == 0 {
+		return nil, 0, time.Time{}, err
+	}
+	var last LoginAttempt
+	err = query.Order("date DESC").First(&last).Error
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return nil, failures, last.Date, nil
+}
+
+//registerLoginFailure bans the address (and its subnet) of a failed login when they reached --ip-failures-ban-threshold (or --subnet-failures-ban-threshold)
+func registerLoginFailure(r *realmInfo, la LoginAttempt) {
+	if la.AuthType != "password" || !isOneOf(la.Reason, bruteForceFailureReasons) {
+		return
+	}
+	bruteForceFailureCounter.Inc()
+	for _, scope := range []string{"ip", "subnet"} {
+		address := la.ClientIP
+		banThreshold := opt.ipFailuresBanThreshold
+		if scope == "subnet" {
+			address = la.Network
+			banThreshold = opt.subnetFailuresBanThreshold
+		}
+		if banThreshold <= 0 {
+			continue
+		}
+		ban, failures, _, err := loadAddressFailures(r, address)
+		if err != nil {
+			logrus.Warnf("Couldn't load login failures of %s. err=%s", address, err)
+			continue
+		}
+		if ban != nil || failures < banThreshold {
+			continue
+		}
+		ban = &IPBan{
+			ID:             uuid.New().String(),
+			Realm:          r.Name,
+			Scope:          scope,
+			Address:        address,
+			Failures:       failures,
+			CreationDate:   time.Now(),
+			ExpirationDate: time.Now().Add(time.Duration(opt.ipBanMinutes) * time.Minute),
+		}
+		err = db.Create(ban).Error
+		if err != nil {
+			logrus.Warnf("Couldn't ban %s %s. err=%s", scope, address, err)
+			continue
+		}
+		logrus.Warnf("%s %s banned until %s after %d login failures", scope, address, ban.ExpirationDate.Format(time.RFC3339), failures)
+		bruteForceBanCounter.WithLabelValues(scope).Inc()
+		saveAuditEvent(r.Name, "ip.ban", "system", address, la.ClientIP, true, map[string]interface{}{"scope": scope, "failures": failures, "expirationDate": ban.ExpirationDate.Format(time.RFC3339)})
+
+		//bans that ended before the failures window don't affect counting anymore
+		err = db.Delete(IPBan{}, "expiration_date < ?", time.Now().Add(-time.Duration(opt.ipFailuresWindowMinutes)*time.Minute)).Error
+		if err != nil {
+			logrus.Warnf("Couldn't remove old ip bans. err=%s", err)
+		}
+	}
+}
+
+//countActiveIPBans is used by the active bans gauge
+func countActiveIPBans() float64 {
+	count := 0
+	err := db.Model(&IPBan{}).Where("expiration_date > ?", time.Now()).Count(&count).Error
+	if err != nil {
+		logrus.Warnf("Couldn't count active ip bans. err=%s", err)
+	}
+	return float64(count)
+}
+
+//parseTrustedProxies parses a comma separated list of IPs and CIDRs
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			if strings.Contains(p, ":") {
+				p = p + "/128"
+			} else {
+				p = p + "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trusted proxy '%s'", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip string) bool {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(pip) {
+			return true
+		}
+	}
+	return false
+}
+
+//clientIPMiddleware resolves the client address of requests. X-Forwarded-For is honoured only when the request comes from a trusted proxy, and it's
+//read from the right to the left, so the client is the address before the last trusted proxy. Values added by clients themselves are never used
+func clientIPMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.RemoteAddr = resolveClientAddr(c.Request)
+		c.Next()
+	}
+}
+
+func resolveClientAddr(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(req.RemoteAddr))
+	if err != nil || !isTrustedProxy(ip) {
+		return req.RemoteAddr
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return net.JoinHostPort(ip, "0")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupLockoutHandlers(rg *gin.RouterGroup) {
+	rg.POST("/user/:email/unlock", userUnlock())
+	rg.POST("/admin/user/:email/unlock", adminUserUnlock())
+}
+
+//userUnlock unlocks an account with the token sent in the 'account-locked' mail
+func userUnlock() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("userUnlock email=%s", email)
+
+		claims, err := loadAndValidateToken(r, c.Request, "unlock", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid unlock token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		var u User
+		err = db.First(&u, "realm = ? AND email = ? AND enabled = 1", r.Name, email).Error
+		if err != nil {
+			c.JSON(455, gin.H{"message": "Invalid account"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+		if !accountLocked(&u) {
+			c.JSON(460, gin.H{"message": "Account not locked"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+		//tokens of previous lockouts are not accepted
+		iat, _ := claims["iat"].(float64)
+		if int64(iat) < u.WrongPasswordDate.Unix()-1 {
+			c.JSON(450, gin.H{"message": "Invalid unlock token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		err = unlockAccount(&u)
+		if err != nil {
+			logrus.Warnf("Couldn't unlock account %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		logrus.Infof("Account %s unlocked by mail", email)
+		auditEvent(c, "user.unlock", email, email, true, nil)
+		c.JSON(200, gin.H{"message": "Account unlocked"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminUserUnlock() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, valid := processLoadUserAsAdmin(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		err := unlockAccount(u)
+		if err != nil {
+			logrus.Warnf("Couldn't unlock account %s. err=%s", u.Email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		logrus.Infof("Account %s unlocked by admin", u.Email)
+		c.JSON(200, gin.H{"message": "Account unlocked"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//wrongPasswordCount returns the wrong passwords considered for locking an account. Wrong passwords older than --password-lockout-minutes are forgotten, so locked accounts are unlocked after this time
+func wrongPasswordCount(u *User) int {
+	if u.WrongPasswordDate == nil {
+		return 0
+	}
+	if opt.passwordLockoutMinutes > 0 && time.Since(*u.WrongPasswordDate) > time.Duration(opt.passwordLockoutMinutes)*time.Minute {
+		return 0
+	}
+	return int(u.WrongPasswordCount)
+}
+
+func accountLocked(u *User) bool {
+	return wrongPasswordCount(u) >= opt.passwordRetriesMax
+}
+
+//accountUnlockDate returns when a locked account will be unlocked automatically. Nil if it stays locked until unlocked or its password is reset
+func accountUnlockDate(u *User) *time.Time {
+	if opt.passwordLockoutMinutes <= 0 || u.WrongPasswordDate == nil {
+		return nil
+	}
+	d := u.WrongPasswordDate.Add(time.Duration(opt.passwordLockoutMinutes) * time.Minute)
+	return &d
+}
+
+//registerWrongPassword atomically increments the wrong password count of a user. Returns the new count
+func registerWrongPassword(u *User) (int, error) {
+	for i := 0; i < 10; i++ {
+		count := wrongPasswordCount(u) + 1
+		if count > math.MaxUint8 {
+			count = math.MaxUint8
+		}
+		updated, err := compareAndSetWrongPasswordCount(u, count)
+		if err != nil || updated {
+			return count, err
+		}
+		err = db.First(u, "id = ?", u.ID).Error
+		if err != nil {
+			return 0, err
+		}
+	}
+	return 0, fmt.Errorf("Too many concurrent changes of wrong password count")
+}
+
+//clearWrongPasswords atomically zeroes the wrong password count of a user after a successful login. Returns true (without clearing it) if the account was locked meanwhile by concurrent attempts
+func clearWrongPasswords(u *User) (bool, error) {
+	for i := 0; i < 10; i++ {
+		if accountLocked(u) {
+			return true, nil
+		}
+		if u.WrongPasswordCount == 0 && u.WrongPasswordDate == nil {
+			return false, nil
+		}
+		updated, err := compareAndSetWrongPasswordCount(u, 0)
+		if err != nil || updated {
+			return false, err
+		}
+		err = db.First(u, "id = ?", u.ID).Error
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, fmt.Errorf("Too many concurrent changes of wrong password count")
+}
+
+func unlockAccount(u *User) error {
+	return db.Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{"wrong_password_count": 0, "wrong_password_date": nil}).Error
+}
+
+//compareAndSetWrongPasswordCount changes the wrong password count only if it wasn't changed since the user was loaded, so concurrent attempts (possibly in other instances) are never lost.
+//Returns false if it was changed and the user must be reloaded
+func compareAndSetWrongPasswordCount(u *User, count int) (bool, error) {
+	var date *time.Time
+	if count > 0 {
+		now := time.Now()
+		date = &now
+	}
+	res := db.Model(&User{}).Where("id = ? AND wrong_password_count = ?", u.ID, u.WrongPasswordCount).UpdateColumns(map[string]interface{}{"wrong_password_count": count, "wrong_password_date": date})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	u.WrongPasswordCount = uint8(count)
+	u.WrongPasswordDate = date
+	return true, nil
+}
+
+//processOutputAccountLocked responds 465 for login attempts on locked accounts
+func processOutputAccountLocked(u *User, c *gin.Context, pmethod string, ppath string) {
+	resp := gin.H{"message": "Max wrong password retries reached. Reset your password or use the unlock link sent by mail"}
+	unlockDate := accountUnlockDate(u)
+	if unlockDate != nil {
+		resp["unlockDate"] = unlockDate.Format(time.RFC3339)
+	}
+	c.JSON(465, resp)
+	invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+}
+
+//sendAccountLockedMail notifies the user of the lockout with a link for unlocking the account
+func sendAccountLockedMail(r *realmInfo, u User, clientIP string) {
+	subject, htmlBody, ok := r.mailTemplate("account-locked")
+	if !ok {
+		return
+	}
+	_, unlockTokenString, err := createJWTToken(r, u.Email, opt.unlockTokenExpirationMinutes, "unlock", "password", nil)
+	if err == nil {
+		htmlBody = renderMailTemplate(htmlBody,
+			"DISPLAY_NAME", u.Name,
+			"UNLOCK_TOKEN", unlockTokenString,
+			"LOCK_DATE", u.WrongPasswordDate.Format(time.RFC1123),
+			"CLIENT_IP", clientIP,
+			"EMAIL", u.Email)
+		err = sendMail(r, subject, htmlBody, u.Email, u.Name)
+	}
+	if err != nil {
+		logrus.Warnf("Couldn't send account locked mail to %s (%s). err=%s", u.Email, subject, err)
+		mailCounter.WithLabelValues("POST", "account-locked", "500").Inc()
+		return
+	}
+	mailCounter.WithLabelValues("POST", "account-locked", "202").Inc()
+	logrus.Infof("Account locked mail sent to %s", u.Email)
+}
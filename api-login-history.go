@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+//loginFailureReasons maps the response status of POST /token to the reason recorded in login history
+var loginFailureReasons = map[int]string{
+	400: "invalid-request",
+	450: "invalid-credentials",
+	455: "password-expired",
+	460: "account-disabled",
+	465: "account-locked",
+	470: "invitation-required",
+	475: "pending-approval",
+	480: "consent-required",
+	485: "hook-denied",
+	429: "too-many-attempts",
+	500: "server-error",
+	503: "hook-unavailable",
+}
+
+func (h *HTTPServer) setupLoginHistoryHandlers(rg *gin.RouterGroup) {
+	rg.GET("/user/:email/login-history", userLoginHistory())
+	rg.GET("/admin/user/:email/login-history", adminLoginHistory())
+}
+
+func userLoginHistory() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("userLoginHistory email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processOutputLoginHistory(u, c, pmethod, ppath)
+	}
+}
+
+func adminLoginHistory() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, valid := processLoadUserAsAdmin(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processOutputLoginHistory(u, c, pmethod, ppath)
+	}
+}
+
+func processOutputLoginHistory(u *User, c *gin.Context, pmethod string, ppath string) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		c.JSON(400, gin.H{"message": "Invalid limit. Must be between 1 and 500"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+		return
+	}
+
+	attempts := make([]LoginAttempt, 0)
+	err = db.Order("date DESC").Limit(limit).Find(&attempts, "user_id = ?", u.ID).Error
+	if err != nil {
+		logrus.Warnf("Error loading login history of %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+
+	resp := make([]gin.H, 0)
+	for _, la := range attempts {
+		resp = append(resp, gin.H{
+			"date":       la.Date,
+			"success":    la.Success,
+			"reason":     la.Reason,
+			"authType":   la.AuthType,
+			"clientIp":   la.ClientIP,
+			"userAgent":  la.UserAgent,
+			"deviceName": la.DeviceName,
+		})
+	}
+	c.JSON(200, resp)
+	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+}
+
+//recordLoginAttempt appends the result of a POST /token to the login history, based on its response status or on the 'loginFailureReason' set by the handler. When a user signs in from a device and network never seen in previous successful logins, a 'new-signin' mail is sent
+func recordLoginAttempt(r *realmInfo, email string, authType string, c *gin.Context) LoginAttempt {
+	status := c.Writer.Status()
+	la := LoginAttempt{
+		ID:         uuid.New().String(),
+		Realm:      r.Name,
+		Email:      strings.ToLower(email),
+		AuthType:   authType,
+		Success:    status == 200,
+		Reason:     loginFailureReasons[status],
+		ClientIP:   c.ClientIP(),
+		Network:    clientNetwork(c.ClientIP()),
+		UserAgent:  truncate(c.Request.UserAgent(), 255),
+		DeviceName: requestDeviceName(c),
+		Date:       time.Now(),
+	}
+
+	var u *User
+	u0, exists := c.Get("loginUser")
+	if exists {
+		u = u0.(*User)
+		la.UserID = u.ID
+		la.Email = u.Email
+	} else if status == 450 && authType == "password" {
+		la.Reason = "unknown-account"
+	}
+	if reason := c.GetString("loginFailureReason"); reason != "" {
+		la.Reason = reason
+	}
+
+	newDevice := false
+	if la.Success && u != nil {
+		var err error
+		newDevice, err = isNewSigninDevice(u, la.UserAgent, la.Network)
+		if err != nil {
+			logrus.Warnf("Couldn't verify if signin of %s is from a new device. err=%s", u.Email, err)
+		}
+	}
+
+	err := db.Create(&la).Error
+	if err != nil {
+		logrus.Warnf("Couldn't record login attempt of %s. err=%s", la.Email, err)
+	}
+
+	if la.Success {
+		auditEvent(c, "login.success", la.Email, la.Email, true, map[string]interface{}{"authType": authType})
+	} else {
+		auditEvent(c, "login.failure", la.Email, la.Email, false, map[string]interface{}{"authType": authType, "reason": la.Reason})
+	}
+
+	if newDevice {
+		go sendNewSigninMail(r, *u, la)
+	}
+	return la
+}
+
+//isNewSigninDevice returns true if the user signed in before, but never with the same user agent from the same network. The first signin of an account is not considered new
+func isNewSigninDevice(u *User, userAgent string, network string) (bool, error) {
+	count := 0
+	err := db.Model(&LoginAttempt{}).Where("user_id = ? AND success = ?", u.ID, true).Count(&count).Error
+	if err != nil || count == 0 {
+		return false, err
+	}
+	err = db.Model(&LoginAttempt{}).Where("user_id = ? AND success = ? AND user_agent = ? AND network = ?", u.ID, true, userAgent, network).Count(&count).Error
+	return count == 0, err
+}
+
+func sendNewSigninMail(r *realmInfo, u User, la LoginAttempt) {
+	subject, htmlBody, ok := r.mailTemplate("new-signin")
+	if !ok {
+		return
+	}
+	htmlBody = renderMailTemplate(htmlBody,
+		"DISPLAY_NAME", u.Name,
+		"DEVICE_NAME", la.DeviceName,
+		"SIGNIN_DATE", la.Date.Format(time.RFC1123),
+		"CLIENT_IP", la.ClientIP,
+		"EMAIL", u.Email)
+	err := sendMail(r, subject, htmlBody, u.Email, u.Name)
+	if err != nil {
+		logrus.Warnf("Couldn't send new signin mail to %s (%s). err=%s", u.Email, subject, err)
+		mailCounter.WithLabelValues("POST", "new-signin", "500").Inc()
+		return
+	}
+	mailCounter.WithLabelValues("POST", "new-signin", "202").Inc()
+	logrus.Infof("New signin mail sent to %s. device=%s ip=%s", u.Email, la.DeviceName, la.ClientIP)
+}
+
+//clientNetwork returns the /24 (IPv4) or /64 (IPv6) network of an IP so that signins from the same network are not considered new
+func clientNetwork(ip string) string {
+	pip := net.ParseIP(ip)
+	if pip == nil {
+		return ip
+	}
+	if ip4 := pip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: pip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
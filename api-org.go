@@ -0,0 +1,471 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+var orgRoles = []string{"owner", "admin", "member"}
+
+func (h *HTTPServer) setupOrgHandlers(rg *gin.RouterGroup) {
+	rg.POST("/admin/org", adminOrgCreate())
+	rg.GET("/admin/org", adminOrgList())
+	rg.GET("/admin/org/:org", adminOrgGet())
+	rg.DELETE("/admin/org/:org", adminOrgDelete())
+	rg.PUT("/admin/org/:org/member/:email", adminOrgMemberPut())
+	rg.DELETE("/admin/org/:org/member/:email", adminOrgMemberDelete())
+
+	rg.GET("/user/:email/org", userOrgList())
+	rg.POST("/token/org/:org", tokenOrgSelect())
+}
+
+func adminOrgCreate() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		valid := validateField(m, "name", "^.{2,100}$")
+		if !valid {
+			c.JSON(455, gin.H{"message": "Invalid name"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		o := Organization{
+			ID:           uuid.New().String(),
+			Realm:        r.Name,
+			Name:         m["name"],
+			CreationDate: time.Now(),
+		}
+		err = db.Create(&o).Error
+		if err != nil {
+			logrus.Warnf("Error creating organization %s. err=%s", o.Name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Organization %s (%s) created", o.Name, o.ID)
+		c.JSON(201, o)
+		invocationCounter.WithLabelValues(pmethod, ppath, "201").Inc()
+	}
+}
+
+func adminOrgList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		orgs := make([]Organization, 0)
+		err = db.Order("name").Find(&orgs, "realm = ?", r.Name).Error
+		if err != nil {
+			logrus.Warnf("Error listing organizations. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, orgs)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminOrgGet() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		o, success := processLoadOrganization(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		members := make([]orgMember, 0)
+		err = db.Table("memberships").
+			Select("memberships.*, users.email").
+			Joins("JOIN users ON users.id = memberships.user_id").
+			Where("memberships.organization_id = ?", o.ID).
+			Order("users.email").
+			Scan(&members).Error
+		if err != nil {
+			logrus.Warnf("Error listing members of organization %s. err=%s", o.ID, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"id":           o.ID,
+			"name":         o.Name,
+			"creationDate": o.CreationDate,
+			"members":      members,
+		})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminOrgDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		o, success := processLoadOrganization(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Delete(Membership{}, "organization_id = ?", o.ID).Error
+			if err != nil {
+				return err
+			}
+			err = tx.Delete(Invitation{}, "organization_id = ?", o.ID).Error
+			if err != nil {
+				return err
+			}
+			return tx.Delete(o).Error
+		})
+		if err != nil {
+			logrus.Warnf("Error deleting organization %s. err=%s", o.ID, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Organization %s (%s) deleted", o.Name, o.ID)
+		c.JSON(200, gin.H{"message": "Organization deleted"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminOrgMemberPut() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminOrgMemberPut email=%s", email)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		o, success := processLoadOrganization(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		if !isOneOf(m["role"], orgRoles) {
+			c.JSON(455, gin.H{"message": "Invalid role"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		var u User
+		db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
+		if db1.RecordNotFound() {
+			c.JSON(404, gin.H{"message": "Account not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting user %s. err=%s", email, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		mb := Membership{
+			OrganizationID: o.ID,
+			UserID:         u.ID,
+			Role:           m["role"],
+			Scopes:         m["scopes"],
+			CreationDate:   time.Now(),
+		}
+		err = db.Save(&mb).Error
+		if err != nil {
+			logrus.Warnf("Error saving membership of %s in organization %s. err=%s", email, o.ID, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("User %s is now '%s' at organization %s", email, mb.Role, o.ID)
+		c.JSON(200, orgMember{Membership: mb, Email: u.Email})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminOrgMemberDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminOrgMemberDelete email=%s", email)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		o, success := processLoadOrganization(r, c.Param("org"), c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		userIDs := db.Table("users").Select("id").Where("realm = ? AND email = ?", r.Name, email).QueryExpr()
+		db1 := db.Delete(Membership{}, "organization_id = ? AND user_id IN (?)", o.ID, userIDs)
+		if db1.Error != nil {
+			logrus.Warnf("Error deleting membership of %s in organization %s. err=%s", email, o.ID, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if db1.RowsAffected == 0 {
+			c.JSON(404, gin.H{"message": "Membership not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		logrus.Infof("User %s removed from organization %s", email, o.ID)
+		c.JSON(200, gin.H{"message": "Member removed"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func userOrgList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("userOrgList email=%s", email)
+
+		_, err := loadAndValidateToken(r, c.Request, "access", email)
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid access token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		type userOrg struct {
+			OrganizationID string `json:"organizationId"`
+			Name           string `json:"name"`
+			Role           string `json:"role"`
+			Scopes         string `json:"scopes"`
+		}
+		orgs := make([]userOrg, 0)
+		err = db.Table("memberships").
+			Select("memberships.organization_id, organizations.name, memberships.role, memberships.scopes").
+			Joins("JOIN organizations ON organizations.id = memberships.organization_id").
+			Joins("JOIN users ON users.id = memberships.user_id").
+			Where("users.email = ? AND organizations.realm = ?", email, r.Name).
+			Order("organizations.name").
+			Scan(&orgs).Error
+		if err != nil {
+			logrus.Warnf("Error listing organizations of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, orgs)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//TOKEN FOR A SPECIFIC ORGANIZATION
+func tokenOrgSelect() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		orgID := c.Param("org")
+
+		claims, err := loadAndValidateToken(r, c.Request, "refresh", "")
+		if err != nil {
+			c.JSON(450, gin.H{"message": "Invalid refresh token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		authType, ok := claims["authType"].(string)
+		if !ok {
+			logrus.Warnf("Refresh token valid but doesn't have 'authType' claim")
+			c.JSON(450, gin.H{"message": "Invalid refresh token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+		socialToken, _ := claims["socialToken"].(string)
+
+		//the token follows the account, so the user is loaded by 'sub' and then validated by its current email
+		tu, err := loadTokenUser(r, claims)
+		if err != nil {
+			logrus.Debugf("Couldn't load user of refresh token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid refresh token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		logrus.Debugf("Selecting organization %s for %s", orgID, tu.Email)
+
+		u, success := processValidateUserActivated(r, tu.Email, c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		sid, valid := processValidateSession(claims, u, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		validateUserAndOutputTokensToResponse(r, u, c, pmethod, ppath, authType, socialToken, orgID, sid)
+	}
+}
+
+func processLoadOrganization(r *realmInfo, orgID string, c *gin.Context, pmethod string, ppath string) (*Organization, bool) {
+	var o Organization
+	db1 := db.First(&o, "id = ? AND realm = ?", orgID, r.Name)
+	if db1.RecordNotFound() {
+		c.JSON(404, gin.H{"message": "Organization not found"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+		return nil, false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error getting organization %s. err=%s", orgID, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return nil, false
+	}
+	return &o, true
+}
+
+//orgMember is a membership along with the current email of the user
+type orgMember struct {
+	Membership
+	Email string `json:"email"`
+}
+
+//processValidateOrgManager accepts master tokens or access tokens of organization owners/admins.
+//Returns who is acting ('master' or the user id) and the organization role of the user (empty for master)
+func processValidateOrgManager(r *realmInfo, orgID string, c *gin.Context, pmethod string, ppath string) (string, string, bool) {
+	_, err := loadAndValidateMasterToken(c.Request)
+	if err == nil {
+		return "master", "", true
+	}
+
+	claims, err := loadAndValidateToken(r, c.Request, "access", "")
+	if err != nil {
+		c.JSON(450, gin.H{"message": "Invalid access token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return "", "", false
+	}
+
+	u, err := loadTokenUser(r, claims)
+	if err != nil {
+		c.JSON(450, gin.H{"message": "Invalid access token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return "", "", false
+	}
+
+	var mb Membership
+	db1 := membershipsInRealm(r).First(&mb, "memberships.organization_id = ? AND memberships.user_id = ? AND memberships.role IN (?)", orgID, u.ID, []string{"owner", "admin"})
+	if db1.RecordNotFound() {
+		c.JSON(465, gin.H{"message": "Not allowed to manage organization"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+		return "", "", false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error getting membership of %s in organization %s. err=%s", u.Email, orgID, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return "", "", false
+	}
+	return mb.UserID, mb.Role, true
+}
+
+//membershipsInRealm returns a query for memberships of organizations from the realm
+func membershipsInRealm(r *realmInfo) *gorm.DB {
+	return db.Table("memberships").
+		Select("memberships.*").
+		Joins("JOIN organizations ON organizations.id = memberships.organization_id").
+		Where("organizations.realm = ?", r.Name)
+}
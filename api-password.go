@@ -8,14 +8,38 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (h *HTTPServer) setupPasswordHandlers() {
-	h.router.POST("/user/:email/password-reset-request", passwordResetRequest())
-	h.router.POST("/user/:email/password-reset-change", passwordResetChange())
-	h.router.POST("/user/:email/password-change", passwordChange())
+func (h *HTTPServer) setupPasswordHandlers(rg *gin.RouterGroup) {
+	rg.POST("/user/:email/password-reset-request", passwordResetRequest())
+	rg.POST("/user/:email/password-reset-change", passwordResetChange())
+	rg.POST("/user/:email/password-change", passwordChange())
+	rg.GET("/password-policy", passwordPolicyGet())
+}
+
+func passwordPolicyGet() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		p := r.passwordPolicy
+		c.JSON(200, gin.H{
+			"pattern":            r.PasswordValidationRegex,
+			"minLength":          p.MinLength,
+			"maxLength":          p.MaxLength,
+			"minCharClasses":     p.MinCharClasses,
+			"minStrength":        p.MinStrength,
+			"rejectPersonalInfo": p.RejectPersonalInfo,
+			"rejectCommon":       p.RejectCommon,
+			"rejectBreached":     p.RejectBreached,
+			"historySize":        opt.passwordHistorySize,
+			"minAgeHours":        opt.passwordMinAgeHours,
+		})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
 }
 
 func passwordResetRequest() func(*gin.Context) {
@@ -23,13 +47,14 @@ func passwordResetRequest() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
+		r := getRealm(c)
 		email := strings.ToLower(c.Param("email"))
 		logrus.Debugf("passwordResetRequest email=%s", email)
 
 		logrus.Debugf("Sending password reset mail to %s", email)
 
 		var u User
-		db1 := db.First(&u, "email = ?", email)
+		db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
 		err := db1.Error
 		if err != nil && !db1.RecordNotFound() {
 			logrus.Warnf("Error getting user for sending password reset email. email=%s err=%s", email, err)
@@ -45,7 +70,7 @@ func passwordResetRequest() func(*gin.Context) {
 			return
 		}
 
-		_, passwordResetTokenString, err := createJWTToken(email, opt.passwordResetTokenExpirationMinutes, "password-reset", "password", nil)
+		_, passwordResetTokenString, err := createJWTToken(r, email, opt.passwordResetTokenExpirationMinutes, "password-reset", "password", nil)
 		if err != nil {
 			logrus.Warnf("Error creating password reset token for email=%s. err=%s", email, err)
 			c.JSON(500, gin.H{"message": "Server error"})
@@ -53,12 +78,13 @@ func passwordResetRequest() func(*gin.Context) {
 			return
 		}
 
-		htmlBody := strings.ReplaceAll(opt.mailResetPasswordHTMLBody, "DISPLAY_NAME", u.Name)
+		subject, htmlBody, _ := r.mailTemplate("password-reset")
+		htmlBody = strings.ReplaceAll(htmlBody, "DISPLAY_NAME", u.Name)
 		htmlBody = strings.ReplaceAll(htmlBody, "EMAIL", u.Email)
 		htmlBody = strings.ReplaceAll(htmlBody, "PASSWORD_RESET_TOKEN", passwordResetTokenString)
-		err = sendMail(opt.mailResetPasswordSubject, htmlBody, email, u.Name)
+		err = sendMail(r, subject, htmlBody, email, u.Name)
 		if err != nil {
-			logrus.Warnf("Couldn't send password reset email to %s (%s). err=%s", email, opt.mailActivationSubject, err)
+			logrus.Warnf("Couldn't send password reset email to %s (%s). err=%s", email, subject, err)
 			mailCounter.WithLabelValues("POST", "activation", "500").Inc()
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
@@ -67,6 +93,7 @@ func passwordResetRequest() func(*gin.Context) {
 
 		mailCounter.WithLabelValues("POST", "activation", "202").Inc()
 		logrus.Infof("Password reset mail sent to %s", u.Name)
+		auditEvent(c, "password.reset-request", email, email, true, nil)
 		// logrus.Debugf("Password reset token for %s=%s", email, passwordResetTokenString)
 		if opt.mailTokensTests == "true" {
 			logrus.Warnf("ADDING PASSWORD RESET TOKEN TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
@@ -82,11 +109,13 @@ func passwordResetChange() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
+		r := getRealm(c)
 		email := strings.ToLower(c.Param("email"))
 		logrus.Debugf("passwordResetChange email=%s", email)
 
-		_, err := loadAndValidateToken(c.Request, "password-reset", email)
+		_, err := loadAndValidateToken(r, c.Request, "password-reset", email)
 		if err != nil {
+			auditEvent(c, "password.reset", email, email, false, map[string]interface{}{"reason": "invalid-token"})
 			c.JSON(450, gin.H{"message": "Invalid password reset token"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
@@ -101,7 +130,9 @@ func passwordResetChange() func(*gin.Context) {
 			return
 		}
 
-		validateAndChangePassword(email, m, c, pmethod, ppath)
+		if validateAndChangePassword(r, email, m, true, c, pmethod, ppath) {
+			auditEvent(c, "password.reset", email, email, true, nil)
+		}
 	}
 }
 
@@ -110,18 +141,19 @@ func passwordChange() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
+		r := getRealm(c)
 		email := strings.ToLower(c.Param("email"))
 		logrus.Debugf("passwordChange email=%s", email)
 
-		_, err := loadAndValidateToken(c.Request, "access", email)
-		if err != nil {
+		claims, err := loadAndValidateToken(r, c.Request, "", email)
+		if err != nil || (!claimEquals(claims, "typ", "access") && !claimEquals(claims, "typ", "password-change")) {
 			c.JSON(450, gin.H{"message": "Invalid access token"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
 		}
 
 		var u User
-		err = db.First(&u, "email = ? AND activation_date IS NOT NULL AND enabled = 1", email).Error
+		err = db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email).Error
 		if err != nil {
 			c.JSON(455, gin.H{"message": "Invalid account"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
@@ -145,8 +177,8 @@ func passwordChange() func(*gin.Context) {
 			return
 		}
 
-		err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(currentPassword))
-		if err != nil {
+		if !validUserPassword(&u, currentPassword) {
+			auditEvent(c, "password.change", email, email, false, map[string]interface{}{"reason": "invalid-current-password"})
 			c.JSON(470, gin.H{"message": "Invalid current password"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
 			return
@@ -154,67 +186,106 @@ func passwordChange() func(*gin.Context) {
 
 		logrus.Debugf("Current password is valid for password change of %s", email)
 
-		validateAndChangePassword(email, m, c, pmethod, ppath)
+		if opt.passwordMinAgeHours > 0 && time.Since(u.PasswordDate) < time.Duration(opt.passwordMinAgeHours)*time.Hour {
+			auditEvent(c, "password.change", email, email, false, map[string]interface{}{"reason": "min-age"})
+			c.JSON(475, gin.H{"message": fmt.Sprintf("Password was changed less than %d hours ago", opt.passwordMinAgeHours)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "475").Inc()
+			return
+		}
+
+		if validateAndChangePassword(r, email, m, false, c, pmethod, ppath) {
+			auditEvent(c, "password.change", email, email, true, nil)
+		}
 	}
 }
 
-func validateAndChangePassword(email string, bodyContents map[string]string, c *gin.Context, pmethod string, ppath string) {
-
-	logrus.Debugf("Validate password %s", email)
-	valid := validateField(bodyContents, "password", opt.passwordValidationRegex)
-	if !valid {
-		c.JSON(460, gin.H{"message": "Invalid new password"})
-		invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
-		return
-	}
+//validateAndChangePassword saves a new password after validating it and emits the 'password.changed' event. Returns true if the password was changed
+func validateAndChangePassword(r *realmInfo, email string, bodyContents map[string]string, reset bool, c *gin.Context, pmethod string, ppath string) bool {
 
 	logrus.Debugf("Validate account status %s", email)
 	var u User
-	db1 := db.First(&u, "email = ? AND activation_date IS NOT NULL AND enabled = 1", email)
+	db1 := db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email)
 	if db1.RecordNotFound() {
 		c.JSON(455, gin.H{"message": "Invalid account"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
-		return
+		return false
 	}
 
 	if db1.Error != nil {
 		logrus.Warnf("Error getting user %s for password change. err=%s", email, db1.Error)
 		c.JSON(500, gin.H{"message": "Server error"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-		return
+		return false
+	}
+
+	logrus.Debugf("Validate password %s", email)
+	violations := validatePassword(r, bodyContents["password"], u.Email, u.Name)
+	if len(violations) == 0 {
+		reused, err := passwordReused(&u, bodyContents["password"])
+		if err != nil {
+			logrus.Warnf("Couldn't load password history of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return false
+		}
+		if reused {
+			violations = append(violations, passwordViolation{"reused-password", fmt.Sprintf("Password must differ from your last %d passwords", opt.passwordHistorySize)})
+		}
+	}
+	if len(violations) > 0 {
+		c.JSON(460, gin.H{"message": "Invalid new password", "violations": violations})
+		invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+		return false
 	}
 
 	logrus.Debugf("Save new password for %s", email)
 
-	phash, err := bcrypt.GenerateFromPassword([]byte(bodyContents["password"]), bcrypt.MinCost)
+	phash, err := hashPassword(bodyContents["password"])
 	if err != nil {
 		logrus.Warnf("Couldn't hash password for email=%s. err=%s", email, err)
 		c.JSON(500, gin.H{"message": "Server error"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-		return
+		return false
 	}
 
-	err = db.Model(&u).Updates(map[string]interface{}{
-		"password_date":        time.Now(),
-		"password_valid_util":  generatePasswordValidUntil(),
-		"password_hash":        phash,
-		"wrong_password_count": 0,
-		"wrong_password_date":  nil,
-	}).Error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&u).Updates(map[string]interface{}{
+			"password_date":                 time.Now(),
+			"password_valid_until":          generatePasswordValidUntil(),
+			"password_hash":                 phash,
+			"wrong_password_count":          0,
+			"wrong_password_date":           nil,
+			"password_reset_required":       false,
+			"password_expiration_mail_date": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = savePasswordHistory(tx, &u, phash)
+		if err != nil {
+			return err
+		}
+		return saveOutboxEvent(tx, r.Name, "password.changed", passwordChangedData(&u, reset))
+	})
 	if err != nil {
 		logrus.Warnf("Couldn't save new password for email=%s. err=%s", email, err)
 		c.JSON(500, gin.H{"message": "Server error"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-		return
+		return false
 	}
 
 	logrus.Infof("Password for %s changed successfully", email)
+	emitWebhookEvent(r.Name, "password.changed", passwordChangedData(&u, reset))
 	c.JSON(200, gin.H{"message": "Password changed successfully"})
 	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	return true
 }
 
-func resetWrongPasswordCounters(u *User) error {
-	return db.Model(&u).Updates(map[string]interface{}{"wrong_password_count": 0, "wrong_password_date": nil}).Error
+//passwordChangedData is the payload of 'password.changed' events. 'reset' tells if the password was reset by mail instead of changed by the user
+func passwordChangedData(u *User, reset bool) map[string]interface{} {
+	data := userWebhookData(u)
+	data["reset"] = reset
+	return data
 }
 
 func generatePasswordValidUntil() *time.Time {
@@ -225,3 +296,80 @@ func generatePasswordValidUntil() *time.Time {
 	}
 	return passwordValidUntil
 }
+
+//processOutputPasswordExpired responds 455 with a token restricted to POST /user/:email/password-change, so users with expired passwords can change them right away
+func processOutputPasswordExpired(r *realmInfo, u *User, c *gin.Context, pmethod string, ppath string) {
+	_, passwordChangeTokenString, err := createJWTToken(r, u.Email, opt.passwordResetTokenExpirationMinutes, "password-change", "password", nil)
+	if err != nil {
+		logrus.Warnf("Error creating password change token for %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	c.JSON(455, gin.H{"message": "Password expired", "passwordChangeToken": passwordChangeTokenString})
+	invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+}
+
+//runPasswordExpirationMailWorker periodically mails users whose passwords expire in the next --password-expiration-warning-days. Each password is warned about once
+func runPasswordExpirationMailWorker() {
+	for {
+		now := time.Now()
+		users := make([]User, 0)
+		err := db.Find(&users, "password_valid_until > ? AND password_valid_until <= ? AND password_expiration_mail_date IS NULL AND activation_date IS NOT NULL AND enabled = 1 AND deletion_date IS NULL",
+			now, now.Add(time.Duration(opt.passwordExpirationWarningDays)*24*time.Hour)).Error
+		if err != nil {
+			logrus.Warnf("Couldn't load users with expiring passwords. err=%s", err)
+		}
+		realms, err := loadRealms()
+		if err != nil {
+			logrus.Warnf("Couldn't load realms for password expiration mails. err=%s", err)
+			users = nil
+		}
+		for _, u := range users {
+			r, exists := realms[u.Realm]
+			if !exists {
+				continue
+			}
+			sendPasswordExpirationMail(r, u)
+		}
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+func sendPasswordExpirationMail(r *realmInfo, u User) {
+	subject, htmlBody, ok := r.mailTemplate("password-expiration")
+	if !ok {
+		return
+	}
+
+	//claim the mail first, so concurrent instances don't send it twice
+	now := time.Now()
+	db1 := db.Model(&User{}).Where("id = ? AND password_expiration_mail_date IS NULL", u.ID).UpdateColumn("password_expiration_mail_date", now)
+	if db1.Error != nil {
+		logrus.Warnf("Couldn't claim password expiration mail of %s. err=%s", u.Email, db1.Error)
+		return
+	}
+	if db1.RowsAffected == 0 {
+		return
+	}
+
+	daysLeft := int(time.Until(*u.PasswordValidUntil).Hours()/24) + 1
+	htmlBody = renderMailTemplate(htmlBody,
+		"DISPLAY_NAME", u.Name,
+		"EXPIRATION_DATE", u.PasswordValidUntil.Format(time.RFC1123),
+		"DAYS_LEFT", fmt.Sprintf("%d", daysLeft),
+		"EMAIL", u.Email)
+	err := sendMail(r, subject, htmlBody, u.Email, u.Name)
+	if err != nil {
+		logrus.Warnf("Couldn't send password expiration mail to %s (%s). err=%s", u.Email, subject, err)
+		mailCounter.WithLabelValues("POST", "password-expiration", "500").Inc()
+		//release the claim so the mail is retried on the next run
+		err = db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("password_expiration_mail_date", gorm.Expr("NULL")).Error
+		if err != nil {
+			logrus.Warnf("Couldn't release password expiration mail of %s. err=%s", u.Email, err)
+		}
+		return
+	}
+	mailCounter.WithLabelValues("POST", "password-expiration", "202").Inc()
+	logrus.Infof("Password expiration mail sent to %s. daysLeft=%d", u.Email, daysLeft)
+}
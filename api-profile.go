@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+var profileFieldRegexes = map[string]string{
+	"name":   "^.{4,60}$",
+	"locale": "^[a-zA-Z]{2,3}([-_][a-zA-Z0-9]{2,8})*$",
+	"phone":  "^\\+?[0-9 ()-]{6,30}$",
+}
+
+func (h *HTTPServer) setupProfileHandlers(rg *gin.RouterGroup) {
+	rg.GET("/user/:email", profileGet())
+	rg.PATCH("/user/:email", profilePatch())
+}
+
+func profileGet() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("profileGet email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		c.JSON(200, profileResponse(c, u))
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func profilePatch() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("profilePatch email=%s", email)
+
+		u, valid := processLoadProfileUser(r, email, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		m := make(map[string]json.RawMessage)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err := json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(500, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		fields := map[string]*string{
+			"name":     &u.Name,
+			"locale":   &u.Locale,
+			"timezone": &u.Timezone,
+			"phone":    &u.Phone,
+		}
+		for k, f := range fields {
+			raw, exists := m[k]
+			if !exists {
+				continue
+			}
+			var v string
+			err = json.Unmarshal(raw, &v)
+			if err == nil && k != "name" && v == "" {
+				*f = ""
+				continue
+			}
+			if err == nil && k == "timezone" {
+				_, err = time.LoadLocation(v)
+			}
+			if err == nil && profileFieldRegexes[k] != "" && !regexp.MustCompile(profileFieldRegexes[k]).MatchString(v) {
+				err = fmt.Errorf("%s doesn't match %s", v, profileFieldRegexes[k])
+			}
+			if err != nil {
+				logrus.Debugf("Invalid profile field %s. err=%s", k, err)
+				c.JSON(460, gin.H{"message": fmt.Sprintf("Invalid %s", k)})
+				invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+				return
+			}
+			*f = v
+		}
+
+		raw, exists := m["customAttributes"]
+		if exists {
+			attributes, err := mergeCustomAttributes(u.CustomAttributes, raw)
+			if err != nil {
+				c.JSON(465, gin.H{"message": "Invalid customAttributes"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+			violations := validateAttributes(r.attributes, attributes)
+			if len(violations) > 0 {
+				c.JSON(465, gin.H{"message": "Invalid customAttributes", "violations": violations})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+			ca, _ := json.Marshal(attributes)
+			u.CustomAttributes = string(ca)
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&User{}).Where("id = ?", u.ID).Updates(map[string]interface{}{
+				"name":              u.Name,
+				"locale":            u.Locale,
+				"timezone":          u.Timezone,
+				"phone":             u.Phone,
+				"custom_attributes": u.CustomAttributes,
+			}).Error
+			if err != nil {
+				return err
+			}
+			return saveOutboxEvent(tx, r.Name, "user.updated", userWebhookData(u))
+		})
+		if err != nil {
+			logrus.Warnf("Error updating profile of %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Profile of %s updated", email)
+		c.JSON(200, profileResponse(c, u))
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//processLoadProfileUser validates the user's own access token and loads the active user
+func processLoadProfileUser(r *realmInfo, email string, c *gin.Context, pmethod string, ppath string) (*User, bool) {
+	_, err := loadAndValidateToken(r, c.Request, "access", email)
+	if err != nil {
+		c.JSON(450, gin.H{"message": "Invalid access token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return nil, false
+	}
+
+	var u User
+	err = db.First(&u, "realm = ? AND email = ? AND activation_date IS NOT NULL AND enabled = 1", r.Name, email).Error
+	if err != nil {
+		c.JSON(455, gin.H{"message": "Invalid account"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+		return nil, false
+	}
+	return &u, true
+}
+
+//mergeCustomAttributes applies a partial attributes object to the stored ones. Attributes set to null are removed
+func mergeCustomAttributes(current string, patch json.RawMessage) (map[string]interface{}, error) {
+	attributes := make(map[string]interface{})
+	if current != "" {
+		err := json.Unmarshal([]byte(current), &attributes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := make(map[string]interface{})
+	err := json.Unmarshal(patch, &p)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(attributes, k)
+			continue
+		}
+		attributes[k] = v
+	}
+	return attributes, nil
+}
+
+func profileResponse(c *gin.Context, u *User) gin.H {
+	attributes := make(map[string]interface{})
+	if u.CustomAttributes != "" {
+		err := json.Unmarshal([]byte(u.CustomAttributes), &attributes)
+		if err != nil {
+			logrus.Warnf("Couldn't parse custom attributes of user %s. err=%s", u.ID, err)
+		}
+	}
+	roles := make([]string, 0)
+	for _, role := range strings.Split(u.Roles, ",") {
+		if strings.TrimSpace(role) != "" {
+			roles = append(roles, strings.TrimSpace(role))
+		}
+	}
+	return gin.H{
+		"id":               u.ID,
+		"email":            u.Email,
+		"name":             u.Name,
+		"locale":           u.Locale,
+		"timezone":         u.Timezone,
+		"phone":            u.Phone,
+		"customAttributes": attributes,
+		"avatarUrl":        avatarURL(c, u),
+		"roles":            roles,
+		"creationDate":     u.CreationDate.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+var activationMethods = []string{"direct", "mail", "approval", "mail+approval"}
+var signupMethods = []string{"open", "invitation"}
+var activationTokenFormats = []string{"jwt", "code"}
+var tokenSubjects = []string{"id", "email"}
+
+func (h *HTTPServer) setupRealmHandlers() {
+	h.router.GET("/admin/realm", adminRealmList())
+	h.router.GET("/admin/realm/:name", adminRealmGet())
+	h.router.PUT("/admin/realm/:name", adminRealmPut())
+	h.router.DELETE("/admin/realm/:name", adminRealmDelete())
+	h.router.PUT("/admin/realm/:name/mail-template/:template", adminRealmMailTemplatePut())
+}
+
+func adminRealmList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		realms := make([]Realm, 0)
+		err = db.Order("name").Find(&realms).Error
+		if err != nil {
+			logrus.Warnf("Error listing realms. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, realms)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminRealmGet() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		realms, err := loadRealms()
+		if err != nil {
+			logrus.Warnf("Error loading realms. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		r, exists := realms[c.Param("name")]
+		if !exists {
+			c.JSON(404, gin.H{"message": "Realm not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		pubk, err := x509.MarshalPKIXPublicKey(r.publicKey)
+		if err != nil {
+			logrus.Warnf("Couldn't marshal public key of realm %s. err=%s", r.Name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		templates := make([]MailTemplate, 0)
+		for _, mt := range r.mailTemplates {
+			templates = append(templates, mt)
+		}
+
+		c.JSON(200, gin.H{
+			"realm":         r.Realm,
+			"jwtPublicKey":  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubk})),
+			"mailTemplates": templates,
+		})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminRealmPut() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		name := c.Param("name")
+		logrus.Debugf("adminRealmPut name=%s", name)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		if name == defaultRealm {
+			c.JSON(455, gin.H{"message": "Default realm is configured by startup parameters"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		if !regexp.MustCompile("^[a-z0-9][a-z0-9-]{1,59}$").MatchString(name) {
+			c.JSON(460, gin.H{"message": "Invalid realm name"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		var r Realm
+		db1 := db.First(&r, "name = ?", name)
+		if db1.Error != nil && !db1.RecordNotFound() {
+			logrus.Warnf("Error getting realm %s. err=%s", name, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		created := db1.RecordNotFound()
+		if created {
+			r = Realm{
+				Name:                    name,
+				JWTSigningMethod:        "ES256",
+				PasswordValidationRegex: "^.{6,30}$",
+				AccountActivationMethod: "direct",
+				SignupMethod:            "open",
+				ActivationTokenFormat:   "jwt",
+				TokenSubject:            "id",
+				PreSignupHookTimeout:    3000,
+				PreSignupHookFailPolicy: "closed",
+				PreTokenHookTimeout:     3000,
+				PreTokenHookFailPolicy:  "closed",
+				CreationDate:            time.Now(),
+			}
+		}
+
+		fields := map[string]*string{
+			"hosts":                   &r.Hosts,
+			"jwtIssuer":               &r.JWTIssuer,
+			"jwtSigningMethod":        &r.JWTSigningMethod,
+			"jwtSigningKey":           &r.JWTSigningKey,
+			"passwordValidationRegex": &r.PasswordValidationRegex,
+			"accountActivationMethod": &r.AccountActivationMethod,
+			"signupMethod":            &r.SignupMethod,
+			"activationTokenFormat":   &r.ActivationTokenFormat,
+			"tokenSubject":            &r.TokenSubject,
+			"attributesSchema":        &r.AttributesSchema,
+			"passwordPolicy":          &r.PasswordPolicy,
+			"mailSMTPHost":            &r.MailSMTPHost,
+			"mailSMTPUser":            &r.MailSMTPUser,
+			"mailSMTPPass":            &r.MailSMTPPass,
+			"mailFromAddress":         &r.MailFromAddress,
+			"mailFromName":            &r.MailFromName,
+			"googleClientId":          &r.GoogleClientID,
+			"googleClientSecret":      &r.GoogleClientSecret,
+			"facebookClientId":        &r.FacebookClientID,
+			"facebookClientSecret":    &r.FacebookClientSecret,
+			"preSignupHookUrl":        &r.PreSignupHookURL,
+			"preSignupHookFailPolicy": &r.PreSignupHookFailPolicy,
+			"preTokenHookUrl":         &r.PreTokenHookURL,
+			"preTokenHookFailPolicy":  &r.PreTokenHookFailPolicy,
+			"hooksSecret":             &r.HooksSecret,
+		}
+		for k, f := range fields {
+			v, exists := m[k]
+			if exists {
+				*f = v
+			}
+		}
+		port, exists := m["mailSMTPPort"]
+		if exists {
+			r.MailSMTPPort, err = strconv.Atoi(port)
+			if err != nil {
+				c.JSON(465, gin.H{"message": "Invalid mailSMTPPort"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+
+		intFields := map[string]*int{
+			"preSignupHookTimeout": &r.PreSignupHookTimeout,
+			"preTokenHookTimeout":  &r.PreTokenHookTimeout,
+		}
+		for k, f := range intFields {
+			v, exists := m[k]
+			if exists {
+				*f, err = strconv.Atoi(v)
+				if err != nil || *f < 1 {
+					c.JSON(465, gin.H{"message": fmt.Sprintf("Invalid %s", k)})
+					invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+					return
+				}
+			}
+		}
+
+		if !isOneOf(r.PreSignupHookFailPolicy, hookFailPolicies) || !isOneOf(r.PreTokenHookFailPolicy, hookFailPolicies) {
+			c.JSON(465, gin.H{"message": "Invalid hook fail policy. Must be 'open' or 'closed'"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		if r.JWTIssuer == "" || r.MailSMTPHost == "" || r.MailSMTPPort == 0 || r.MailFromAddress == "" || r.MailFromName == "" {
+			c.JSON(465, gin.H{"message": "jwtIssuer, mailSMTPHost, mailSMTPPort, mailFromAddress and mailFromName are required"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		_, err = regexp.Compile(r.PasswordValidationRegex)
+		if err != nil {
+			c.JSON(465, gin.H{"message": "Invalid passwordValidationRegex"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		if !isOneOf(r.AccountActivationMethod, activationMethods) {
+			c.JSON(465, gin.H{"message": "Invalid accountActivationMethod"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		required := activationMailTemplates(r.AccountActivationMethod)
+		if len(required) > 0 {
+			count := 0
+			err = db.Model(&MailTemplate{}).Where("realm = ? AND name IN (?) AND subject <> '' AND html <> ''", name, required).Count(&count).Error
+			if err != nil {
+				logrus.Warnf("Error counting mail templates of realm %s. err=%s", name, err)
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+			if count < len(required) {
+				c.JSON(465, gin.H{"message": fmt.Sprintf("accountActivationMethod '%s' requires the mail templates %s", r.AccountActivationMethod, strings.Join(required, ", "))})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+
+		if !isOneOf(r.SignupMethod, signupMethods) {
+			c.JSON(465, gin.H{"message": "Invalid signupMethod"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		if !isOneOf(r.ActivationTokenFormat, activationTokenFormats) {
+			c.JSON(465, gin.H{"message": "Invalid activationTokenFormat"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		if !isOneOf(r.TokenSubject, tokenSubjects) {
+			c.JSON(465, gin.H{"message": "Invalid tokenSubject"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		_, err = parseAttributesSchema(r.AttributesSchema)
+		if err != nil {
+			c.JSON(465, gin.H{"message": fmt.Sprintf("Invalid attributesSchema. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		_, err = parsePasswordPolicy(r.PasswordPolicy)
+		if err != nil {
+			c.JSON(465, gin.H{"message": fmt.Sprintf("Invalid passwordPolicy. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		_, keyInformed := m["jwtSigningKey"]
+		_, methodInformed := m["jwtSigningMethod"]
+		if r.JWTSigningKey == "" || (methodInformed && !keyInformed) {
+			logrus.Infof("Generating new %s signing key for realm %s", r.JWTSigningMethod, name)
+			r.JWTSigningKey, err = generateSigningKey(r.JWTSigningMethod)
+			if err != nil {
+				c.JSON(465, gin.H{"message": fmt.Sprintf("Couldn't generate signing key. err=%s", err)})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+		_, _, err = parseSigningKey(r.JWTSigningMethod, r.JWTSigningKey)
+		if err != nil {
+			c.JSON(465, gin.H{"message": fmt.Sprintf("Invalid jwtSigningKey. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+			return
+		}
+
+		err = db.Save(&r).Error
+		if err != nil {
+			logrus.Warnf("Error saving realm %s. err=%s", name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		invalidateRealmCache()
+
+		if created {
+			logrus.Infof("Realm %s created", name)
+			c.JSON(201, r)
+			invocationCounter.WithLabelValues(pmethod, ppath, "201").Inc()
+			return
+		}
+		logrus.Infof("Realm %s updated", name)
+		c.JSON(200, r)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+//activationMailTemplates returns the mail templates an account activation method sends
+func activationMailTemplates(method string) []string {
+	templates := make([]string, 0)
+	if strings.HasPrefix(method, "mail") {
+		templates = append(templates, "activation")
+	}
+	if strings.HasSuffix(method, "approval") {
+		templates = append(templates, "approval", "rejection")
+	}
+	return templates
+}
+
+func adminRealmDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		name := c.Param("name")
+		logrus.Debugf("adminRealmDelete name=%s", name)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		if name == defaultRealm {
+			c.JSON(455, gin.H{"message": "Default realm is configured by startup parameters"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		count := 0
+		err = db.Model(&User{}).Where("realm = ? AND erasure_date IS NULL", name).Count(&count).Error
+		if err != nil {
+			logrus.Warnf("Error counting users of realm %s. err=%s", name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if count > 0 {
+			c.JSON(460, gin.H{"message": "Realm has users"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		rowsAffected := int64(0)
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Delete(Membership{}, "organization_id IN (?)", tx.Table("organizations").Select("id").Where("realm = ?", name).SubQuery()).Error
+			if err != nil {
+				return err
+			}
+			//anonymized rows of erased accounts are the only users left
+			for _, model := range []interface{}{Organization{}, Invitation{}, EmailChange{}, Consent{}, Session{}, PasswordHistory{}, LoginAttempt{}, IPBan{}, AuditEvent{}, OutboxEvent{}, WebhookDelivery{}, Webhook{}, MailTemplate{}, ConsentDocument{}, User{}} {
+				err = tx.Delete(model, "realm = ?", name).Error
+				if err != nil {
+					return err
+				}
+			}
+			db1 := tx.Delete(Realm{}, "name = ?", name)
+			rowsAffected = db1.RowsAffected
+			return db1.Error
+		})
+		if err != nil {
+			logrus.Warnf("Error deleting realm %s. err=%s", name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if rowsAffected == 0 {
+			c.JSON(404, gin.H{"message": "Realm not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		invalidateRealmCache()
+
+		logrus.Infof("Realm %s deleted", name)
+		c.JSON(200, gin.H{"message": "Realm deleted"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminRealmMailTemplatePut() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		name := c.Param("name")
+		template := c.Param("template")
+		logrus.Debugf("adminRealmMailTemplatePut name=%s template=%s", name, template)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		if db.First(&Realm{}, "name = ?", name).RecordNotFound() {
+			c.JSON(404, gin.H{"message": "Realm not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		if !validateField(m, "subject", "^.{1,255}$") || !validateField(m, "html", "(?s)^.+$") {
+			c.JSON(455, gin.H{"message": "subject and html are required"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return
+		}
+
+		mt := MailTemplate{
+			Realm:   name,
+			Name:    template,
+			Subject: m["subject"],
+			HTML:    m["html"],
+		}
+		err = db.Save(&mt).Error
+		if err != nil {
+			logrus.Warnf("Error saving mail template %s for realm %s. err=%s", template, name, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		invalidateRealmCache()
+
+		logrus.Infof("Mail template %s saved for realm %s", template, name)
+		c.JSON(200, mt)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
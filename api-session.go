@@ -0,0 +1,295 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+func (h *HTTPServer) setupSessionHandlers(rg *gin.RouterGroup) {
+	rg.GET("/user/:email/session", userSessionList())
+	rg.DELETE("/user/:email/session/:id", userSessionRevoke())
+	rg.DELETE("/user/:email/session", userSessionRevokeOthers())
+	rg.GET("/admin/user/:email/session", adminSessionList())
+	rg.DELETE("/admin/user/:email/session/:id", adminSessionRevoke())
+	rg.DELETE("/admin/user/:email/session", adminSessionRevokeAll())
+}
+
+func userSessionList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, claims, valid := processLoadSessionUser(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		sid, _ := claims["sid"].(string)
+		processOutputSessions(u, sid, c, pmethod, ppath)
+	}
+}
+
+func userSessionRevoke() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, _, valid := processLoadSessionUser(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processRevokeSessions(u, "id = ?", []interface{}{c.Param("id")}, c, pmethod, ppath)
+	}
+}
+
+func userSessionRevokeOthers() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, claims, valid := processLoadSessionUser(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		sid, _ := claims["sid"].(string)
+		processRevokeSessions(u, "id <> ?", []interface{}{sid}, c, pmethod, ppath)
+	}
+}
+
+func adminSessionList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, valid := processLoadUserAsAdmin(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processOutputSessions(u, "", c, pmethod, ppath)
+	}
+}
+
+func adminSessionRevoke() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, valid := processLoadUserAsAdmin(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processRevokeSessions(u, "id = ?", []interface{}{c.Param("id")}, c, pmethod, ppath)
+	}
+}
+
+func adminSessionRevokeAll() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		u, valid := processLoadUserAsAdmin(c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		processRevokeSessions(u, "1 = 1", []interface{}{}, c, pmethod, ppath)
+	}
+}
+
+func processLoadSessionUser(c *gin.Context, pmethod string, ppath string) (*User, jwt.MapClaims, bool) {
+	r := getRealm(c)
+	email := strings.ToLower(c.Param("email"))
+	claims, err := loadAndValidateToken(r, c.Request, "access", email)
+	if err != nil {
+		c.JSON(450, gin.H{"message": "Invalid access token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return nil, nil, false
+	}
+
+	var u User
+	err = db.First(&u, "realm = ? AND email = ? AND enabled = 1", r.Name, email).Error
+	if err != nil {
+		c.JSON(455, gin.H{"message": "Invalid account"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+		return nil, nil, false
+	}
+	return &u, claims, true
+}
+
+func processLoadUserAsAdmin(c *gin.Context, pmethod string, ppath string) (*User, bool) {
+	r := getRealm(c)
+	email := strings.ToLower(c.Param("email"))
+	_, err := loadAndValidateMasterToken(c.Request)
+	if err != nil {
+		logrus.Debugf("Invalid master token. err=%s", err)
+		c.JSON(450, gin.H{"message": "Invalid master token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return nil, false
+	}
+
+	var u User
+	db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
+	if db1.RecordNotFound() {
+		c.JSON(404, gin.H{"message": "User not found"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+		return nil, false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error loading user %s. err=%s", email, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return nil, false
+	}
+	return &u, true
+}
+
+func processOutputSessions(u *User, currentSessionID string, c *gin.Context, pmethod string, ppath string) {
+	sessions, err := loadActiveSessions(u)
+	if err != nil {
+		logrus.Warnf("Error listing sessions of %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	resp := make([]gin.H, 0)
+	for _, s := range sessions {
+		resp = append(resp, gin.H{
+			"id":           s.ID,
+			"deviceName":   s.DeviceName,
+			"userAgent":    s.UserAgent,
+			"clientIp":     s.ClientIP,
+			"authType":     s.AuthType,
+			"creationDate": s.CreationDate,
+			"lastSeenDate": s.LastSeenDate,
+			"current":      s.ID == currentSessionID,
+		})
+	}
+	c.JSON(200, resp)
+	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+}
+
+func processRevokeSessions(u *User, where string, args []interface{}, c *gin.Context, pmethod string, ppath string) {
+	db1 := db.Model(&Session{}).Where("user_id = ? AND revocation_date IS NULL", u.ID).Where(where, args...).UpdateColumn("revocation_date", time.Now())
+	if db1.Error != nil {
+		logrus.Warnf("Error revoking sessions of %s. err=%s", u.Email, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return
+	}
+	if c.Param("id") != "" && db1.RowsAffected == 0 {
+		c.JSON(404, gin.H{"message": "Session not found"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+		return
+	}
+	logrus.Infof("%d sessions of %s revoked", db1.RowsAffected, u.Email)
+	actor := u.Email
+	if strings.Contains(ppath, "/admin/") {
+		actor = "master"
+	}
+	auditEvent(c, "token.revoke", actor, u.Email, true, map[string]interface{}{"sessions": db1.RowsAffected})
+	c.JSON(200, gin.H{"message": "Sessions revoked", "count": db1.RowsAffected})
+	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+}
+
+//loadActiveSessions returns the sessions that weren't revoked and whose refresh tokens may still be valid
+func loadActiveSessions(u *User) ([]Session, error) {
+	sessions := make([]Session, 0)
+	minLastSeen := time.Now().Add(-time.Duration(opt.refreshTokenDefaultExpirationMinutes) * time.Minute)
+	err := db.Order("last_seen_date DESC").Find(&sessions, "user_id = ? AND revocation_date IS NULL AND last_seen_date > ?", u.ID, minLastSeen).Error
+	return sessions, err
+}
+
+//processValidateSession verifies if the session of a refresh token was not revoked. Refresh tokens issued before sessions existed have no 'sid' and are accepted
+func processValidateSession(claims jwt.MapClaims, u *User, c *gin.Context, pmethod string, ppath string) (string, bool) {
+	sid, exists := claims["sid"].(string)
+	if !exists {
+		return "", true
+	}
+	db1 := db.First(&Session{}, "id = ? AND user_id = ? AND revocation_date IS NULL", sid, u.ID)
+	if db1.RecordNotFound() {
+		logrus.Debugf("Session %s of %s was revoked", sid, u.Email)
+		c.JSON(450, gin.H{"message": "Invalid refresh token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return "", false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error loading session %s. err=%s", sid, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return "", false
+	}
+	return sid, true
+}
+
+//saveSession creates a new session for logins or updates the last seen date of an existing one on token refreshes. Device name is the 'deviceName' informed on login or is derived from the user agent
+func saveSession(u *User, sessionID string, authType string, c *gin.Context) (string, error) {
+	now := time.Now()
+	if sessionID != "" {
+		return sessionID, db.Model(&Session{}).Where("id = ?", sessionID).UpdateColumns(map[string]interface{}{
+			"last_seen_date": now,
+			"client_ip":      c.ClientIP(),
+		}).Error
+	}
+	s := Session{
+		ID:           uuid.New().String(),
+		Realm:        u.Realm,
+		UserID:       u.ID,
+		DeviceName:   requestDeviceName(c),
+		UserAgent:    truncate(c.Request.UserAgent(), 255),
+		ClientIP:     c.ClientIP(),
+		AuthType:     authType,
+		CreationDate: now,
+		LastSeenDate: now,
+	}
+	return s.ID, db.Create(&s).Error
+}
+
+//requestDeviceName returns the 'deviceName' informed on login or a name derived from the user agent
+func requestDeviceName(c *gin.Context) string {
+	deviceName := c.GetString("deviceName")
+	if deviceName == "" {
+		deviceName = deviceNameFromUserAgent(c.Request.UserAgent())
+	}
+	return truncate(deviceName, 100)
+}
+
+//deviceNameFromUserAgent returns a friendly name such as 'Chrome on Windows'
+func deviceNameFromUserAgent(ua string) string {
+	browsers := []struct{ token, name string }{{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"}, {"curl/", "curl"}}
+	systems := []struct{ token, name string }{{"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Android", "Android"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"}}
+	browser := ""
+	for _, b := range browsers {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	system := ""
+	for _, s := range systems {
+		if strings.Contains(ua, s.token) {
+			system = s.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	case ua != "":
+		return truncate(ua, 100)
+	}
+	return "Unknown device"
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
@@ -5,13 +5,16 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 )
 
 func processFacebookLogin(m map[string]string, shortLivedFacebookToken string, c *gin.Context, pmethod string, ppath string) {
 	logrus.Debugf("Authentication using Facebook login")
 
-	if opt.facebookClientID == "" || opt.facebookClientSecret == "" {
+	r := getRealm(c)
+	if r.FacebookClientID == "" || r.FacebookClientSecret == "" {
 		c.JSON(400, gin.H{"message": "Facebook login disabled"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
 		return
@@ -20,13 +23,13 @@ func processFacebookLogin(m map[string]string, shortLivedFacebookToken string, c
 	//https://developers.facebook.com/docs/facebook-login/access-tokens/refreshing/
 
 	logrus.Debugf("Checking short lived user token validity at facebook")
-	temail, tname, success := processFacebookToken(c, shortLivedFacebookToken, pmethod, ppath)
+	temail, tname, _, success := processFacebookToken(c, shortLivedFacebookToken, pmethod, ppath)
 	if !success {
 		return
 	}
 
 	logrus.Debugf("Exchanging user short lived FB token by a user long lived one")
-	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/v7.0/oauth/access_token?grant_type=fb_exchange_token&client_id=%s&client_secret=%s&fb_exchange_token=%s", opt.facebookClientID, opt.facebookClientSecret, shortLivedFacebookToken), "", "", nil, 200)
+	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/v7.0/oauth/access_token?grant_type=fb_exchange_token&client_id=%s&client_secret=%s&fb_exchange_token=%s", r.FacebookClientID, r.FacebookClientSecret, shortLivedFacebookToken), "", "", nil, 200)
 	if err != nil {
 		logrus.Warnf("Error calling Facebook to get a long lived token. err=%s", err)
 		c.JSON(400, gin.H{"message": "Couldn't exchange Facebook tokens"})
@@ -44,30 +47,30 @@ func processFacebookLogin(m map[string]string, shortLivedFacebookToken string, c
 	longLivedUserFacebookToken := longLivedUserFacebookToken0.(string)
 
 	logrus.Debugf("Checking facebook token validity")
-	temail, tname, success = processFacebookToken(c, longLivedUserFacebookToken, pmethod, ppath)
+	temail, tname, picture, success := processFacebookToken(c, longLivedUserFacebookToken, pmethod, ppath)
 	if !success {
 		return
 	}
-	logrus.Debugf("Facebook token valid for %s. Checking if account already exists")
+	logrus.Debugf("Facebook token valid for %s. Checking if account already exists", temail)
 
 	authType := "facebook"
-	success = processCreateActivatedUserIfNeeded(c, temail, tname, pmethod, ppath, authType)
+	success = processCreateActivatedUserIfNeeded(r, c, temail, tname, picture, pmethod, ppath, authType)
 	if !success {
 		return
 	}
 
-	u, success := processValidateUserActivated(temail, c, pmethod, ppath)
+	u, success := processValidateUserActivated(r, temail, c, pmethod, ppath)
 	if !success {
 		return
 	}
 
-	validateUserAndOutputTokensToResponse(u, c, pmethod, ppath, authType, longLivedUserFacebookToken)
+	validateUserAndOutputTokensToResponse(r, u, c, pmethod, ppath, authType, longLivedUserFacebookToken, "", "")
 	logrus.Debugf("Facebook login for %s", u.Email)
 }
 
-func processFacebookRefreshToken(c *gin.Context, facebookToken string, pmethod string, ppath string) (newFacebookToken string, success bool) {
+func processFacebookRefreshToken(r *realmInfo, c *gin.Context, facebookToken string, pmethod string, ppath string) (newFacebookToken string, success bool) {
 	logrus.Debugf("Renewing Facebook token for refresh")
-	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/v7.0/oauth/access_token?grant_type=fb_exchange_token&client_id=%s&client_secret=%s&fb_exchange_token=%s", opt.facebookClientID, opt.facebookClientSecret, facebookToken), "", "", nil, 200)
+	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/v7.0/oauth/access_token?grant_type=fb_exchange_token&client_id=%s&client_secret=%s&fb_exchange_token=%s", r.FacebookClientID, r.FacebookClientSecret, facebookToken), "", "", nil, 200)
 	if err != nil {
 		logrus.Warnf("Error calling Facebook to renew token during refresh. err=%s", err)
 		c.JSON(400, gin.H{"message": "Couldn't exchange Facebook tokens"})
@@ -89,7 +92,8 @@ func processFacebookRefreshToken(c *gin.Context, facebookToken string, pmethod s
 func processGoogleLogin(m map[string]string, googleAuthCode string, c *gin.Context, pmethod string, ppath string) {
 	logrus.Debugf("Authentication using Google login")
 
-	if opt.googleClientID == "" || opt.googleClientSecret == "" {
+	r := getRealm(c)
+	if r.GoogleClientID == "" || r.GoogleClientSecret == "" {
 		c.JSON(400, gin.H{"message": "Google login disabled"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
 		return
@@ -97,7 +101,7 @@ func processGoogleLogin(m map[string]string, googleAuthCode string, c *gin.Conte
 
 	logrus.Debugf("Exchanging Google authorization code by a refresh token")
 
-	body := fmt.Sprintf(`client_id=%s&client_secret=%s&redirect_uri=http://localhost:3000&grant_type=authorization_code&code=%s`, opt.googleClientID, opt.googleClientSecret, googleAuthCode)
+	body := fmt.Sprintf(`client_id=%s&client_secret=%s&redirect_uri=http://localhost:3000&grant_type=authorization_code&code=%s`, r.GoogleClientID, r.GoogleClientSecret, googleAuthCode)
 	resp, err := requestURLWithJsonResponse("POST", "https://oauth2.googleapis.com/token", body, "application/x-www-form-urlencoded", nil, 200)
 	if err != nil {
 		logrus.Warnf("Error calling Google to exchange code by refresh token. err=%s", err)
@@ -116,45 +120,45 @@ func processGoogleLogin(m map[string]string, googleAuthCode string, c *gin.Conte
 	}
 	googleRefreshToken := googleRefreshToken0.(string)
 
-	temail, tname, success := processGoogleRefreshToken(c, googleRefreshToken, pmethod, ppath)
+	temail, tname, picture, success := processGoogleRefreshToken(r, c, googleRefreshToken, pmethod, ppath)
 	if !success {
 		return
 	}
 	logrus.Debugf("Google refresh token valid for %s", temail)
 
 	authType := "google"
-	success = processCreateActivatedUserIfNeeded(c, temail, tname, pmethod, ppath, authType)
+	success = processCreateActivatedUserIfNeeded(r, c, temail, tname, picture, pmethod, ppath, authType)
 	if !success {
 		return
 	}
 
-	u, success := processValidateUserActivated(temail, c, pmethod, ppath)
+	u, success := processValidateUserActivated(r, temail, c, pmethod, ppath)
 	if !success {
 		return
 	}
 
-	validateUserAndOutputTokensToResponse(u, c, pmethod, ppath, "google", googleRefreshToken)
+	validateUserAndOutputTokensToResponse(r, u, c, pmethod, ppath, "google", googleRefreshToken, "", "")
 	logrus.Debugf("Google login for %s", u.Email)
 
 	return
 }
 
-func processGoogleRefreshToken(c *gin.Context, googleRefreshToken string, pmethod string, ppath string) (email string, name string, success bool) {
+func processGoogleRefreshToken(r *realmInfo, c *gin.Context, googleRefreshToken string, pmethod string, ppath string) (email string, name string, picture string, success bool) {
 	logrus.Debugf("Getting Google Access Token from Refresh token")
 
 	headers := make(map[string]string)
-	body := fmt.Sprintf(`client_id=%s&client_secret=%s&grant_type=refresh_token&refresh_token=%s`, opt.googleClientID, opt.googleClientSecret, googleRefreshToken)
+	body := fmt.Sprintf(`client_id=%s&client_secret=%s&grant_type=refresh_token&refresh_token=%s`, r.GoogleClientID, r.GoogleClientSecret, googleRefreshToken)
 	resp, err := requestURLWithJsonResponse("POST", "https://accounts.google.com/o/oauth2/token", body, "application/x-www-form-urlencoded", headers, 200)
 	if err != nil {
 		logrus.Infof("Error calling Google to get access token from refresh token. err=%s", err)
 		c.JSON(400, gin.H{"message": "Couldn't refresh token"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
-		return email, name, false
+		return email, name, picture, false
 	}
 
 	accessToken0, exists := resp["access_token"]
 	if !exists {
-		return email, name, false
+		return email, name, picture, false
 	}
 	googleAccessToken := accessToken0.(string)
 	logrus.Debugf("Got access token from Google")
@@ -164,42 +168,44 @@ func processGoogleRefreshToken(c *gin.Context, googleRefreshToken string, pmetho
 		logrus.Infof("Error calling Google to get profile info from access token. err=%s", err)
 		c.JSON(400, gin.H{"message": "Couldn't refresh token"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
-		return email, name, false
+		return email, name, picture, false
 	}
 	logrus.Debugf("Google user info=%v", resp)
 
 	email0, exists := resp["email"]
 	if !exists {
 		logrus.Infof("No 'email' in google profile response")
-		return email, name, false
+		return email, name, picture, false
 	}
 	email = email0.(string)
 
 	name0, exists := resp["name"]
 	if !exists {
 		logrus.Infof("No 'name' in google profile response")
-		return email, name, false
+		return email, name, picture, false
 	}
 	name = name0.(string)
 
-	return email, name, true
+	picture, _ = resp["picture"].(string)
+
+	return email, name, picture, true
 }
 
-func processFacebookToken(c *gin.Context, facebookRefreshToken string, pmethod string, ppath string) (email string, name string, success bool) {
+func processFacebookToken(c *gin.Context, facebookRefreshToken string, pmethod string, ppath string) (email string, name string, picture string, success bool) {
 	// logrus.Debugf("FB token=%s", facebookToken)
-	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/me?fields=email,name,id&access_token=%s", facebookRefreshToken), "", "", nil, 200)
+	resp, err := requestURLWithJsonResponse("GET", fmt.Sprintf("https://graph.facebook.com/me?fields=email,name,id,picture.type(large)&access_token=%s", facebookRefreshToken), "", "", nil, 200)
 	if err != nil {
 		logrus.Warnf("Facebook didn't validate token. body=%v", resp)
 		c.JSON(400, gin.H{"message": "Token could not be validated at Facebook"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
-		return "", "", false
+		return "", "", "", false
 	}
 
 	temail1, exists := resp["email"]
 	if !exists {
 		c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't get email from Facebook token")})
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
-		return "", "", false
+		return "", "", "", false
 	}
 
 	//FB bug: https://stackoverflow.com/questions/13510458/golang-convert-iso8859-1-to-utf8
@@ -211,7 +217,14 @@ func processFacebookToken(c *gin.Context, facebookRefreshToken string, pmethod s
 		invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
 		return
 	}
-	return temail, tname.(string), true
+	//silhouettes are the default Facebook pictures for users without one
+	pic, _ := resp["picture"].(map[string]interface{})
+	picData, _ := pic["data"].(map[string]interface{})
+	silhouette, _ := picData["is_silhouette"].(bool)
+	if !silhouette {
+		picture, _ = picData["url"].(string)
+	}
+	return temail, tname.(string), picture, true
 }
 
 func toUtf8(iso88591str string) string {
@@ -223,27 +236,50 @@ func toUtf8(iso88591str string) string {
 	return string(buf)
 }
 
-func processCreateActivatedUserIfNeeded(c *gin.Context, email string, name string, pmethod string, ppath string, authType string) bool {
+//processCreateActivatedUserIfNeeded creates accounts on the first social login. The social profile picture (if any) is imported as the user avatar.
+//Invitation only realms don't create accounts on social logins, as invitations are accepted on signup (PUT /user/:email)
+func processCreateActivatedUserIfNeeded(r *realmInfo, c *gin.Context, email string, name string, picture string, pmethod string, ppath string, authType string) bool {
 	u := User{}
-	if db.First(&u, "email = ?", email).RecordNotFound() {
+	if db.First(&u, "realm = ? AND email = ?", r.Name, email).RecordNotFound() {
+		if r.SignupMethod == "invitation" {
+			logrus.Infof("User %s not found and realm %s is invitation only. Not creating user for %s login", email, r.Name, authType)
+			c.JSON(470, gin.H{"message": "Valid invitation required"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+			return false
+		}
 		logrus.Debugf("User %s not found. Auto creating user for %s login", email, authType)
-		t := time.Now()
-		u.ActivationDate = &t
+		if !processPreSignupHook(r, email, name, authType, c, pmethod, ppath) {
+			return false
+		}
 		u = User{
-			Name:           name,
-			Email:          email,
-			Enabled:        1,
-			CreationDate:   time.Now(),
-			ActivationDate: &t,
+			ID:           uuid.New().String(),
+			Realm:        r.Name,
+			Name:         name,
+			Email:        email,
+			Enabled:      1,
+			CreationDate: time.Now(),
 		}
-		err := db.Create(&u).Error
+		//social providers already proved email ownership, but admin approval is still required
+		initAccountActivation(r, &u, true)
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Create(&u).Error
+			if err != nil {
+				return err
+			}
+			return saveOutboxEvent(tx, r.Name, "user.created", userWebhookData(&u))
+		})
 		if err != nil {
 			logrus.Warnf("Error creating user email=%s for %s login. err=%s", email, authType, err)
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 			return false
 		}
-		logrus.Debugf("New account created from %s login. email=%s", authType, email)
+		logrus.Debugf("New account created from %s login. email=%s approvalStatus=%s", authType, email, u.ApprovalStatus)
+		auditEvent(c, "user.signup", email, email, true, map[string]interface{}{"authType": authType})
+		emitWebhookEvent(r.Name, "user.created", userWebhookData(&u))
+		if picture != "" {
+			go importAvatar(r, &u, picture)
+		}
 	}
 	return true
 }
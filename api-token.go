@@ -9,14 +9,14 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (h *HTTPServer) setupTokenHandlers() {
-	h.router.POST("/token", tokenCreate())
-	h.router.POST("/token/refresh", tokenRefresh())
-	h.router.GET("/token", tokenInfo())
+func (h *HTTPServer) setupTokenHandlers(rg *gin.RouterGroup) {
+	rg.POST("/token", tokenCreate())
+	rg.POST("/token/refresh", tokenRefresh())
+	rg.GET("/token", tokenInfo())
 }
 
 //TOKEN CREATION
@@ -33,20 +33,24 @@ func tokenCreate() func(*gin.Context) {
 			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
 			return
 		}
+		c.Set("deviceName", m["deviceName"])
 
-		facebookToken, exists := m["facebookToken"]
-		if exists {
+		authType := "password"
+		if facebookToken, exists := m["facebookToken"]; exists {
+			authType = "facebook"
 			processFacebookLogin(m, facebookToken, c, pmethod, ppath)
-			return
-		}
-
-		googleAuthCode, exists := m["googleAuthCode"]
-		if exists {
+		} else if googleAuthCode, exists := m["googleAuthCode"]; exists {
+			authType = "google"
 			processGoogleLogin(m, googleAuthCode, c, pmethod, ppath)
-			return
+		} else if processLoginThrottling(getRealm(c), c, pmethod, ppath) {
+			processLocalPasswordLogin(m, c, pmethod, ppath)
 		}
 
-		processLocalPasswordLogin(m, c, pmethod, ppath)
+		la := recordLoginAttempt(getRealm(c), m["email"], authType, c)
+		if !la.Success {
+			emitWebhookEvent(la.Realm, "login.failed", map[string]interface{}{"id": la.UserID, "email": la.Email, "authType": authType, "reason": la.Reason, "clientIp": la.ClientIP})
+			registerLoginFailure(getRealm(c), la)
+		}
 	}
 }
 
@@ -60,7 +64,8 @@ func processLocalPasswordLogin(m map[string]string, c *gin.Context, pmethod stri
 		return
 	}
 
-	u, success := processValidateUserActivated(email, c, pmethod, ppath)
+	//accounts pending approval are only revealed after the password is verified
+	u, success := processLoadLoginUser(getRealm(c), email, c, pmethod, ppath)
 	if !success {
 		return
 	}
@@ -73,31 +78,38 @@ func processLocalPasswordLogin(m map[string]string, c *gin.Context, pmethod stri
 		return
 	}
 	logrus.Debugf("Verify wrong password retries")
-	if u.WrongPasswordDate != nil {
-		if int(u.WrongPasswordCount) >= opt.passwordRetriesMax {
-			logrus.Infof("Max wrong password retries reached for %s. Account locked", email)
-			c.JSON(465, gin.H{"message": "Max wrong password retries reached. Reset your password"})
-			invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
-			return
-		}
-		delaySeconds := opt.passwordRetriesTimeSeconds * int(math.Pow(2, float64(u.WrongPasswordCount)))
+	wrongPasswords := wrongPasswordCount(u)
+	if wrongPasswords >= opt.passwordRetriesMax {
+		logrus.Infof("Max wrong password retries reached for %s. Account locked", email)
+		processOutputAccountLocked(u, c, pmethod, ppath)
+		return
+	}
+	if wrongPasswords > 0 {
+		delaySeconds := opt.passwordRetriesTimeSeconds * int(math.Pow(2, float64(wrongPasswords)))
 		if time.Now().Before(u.WrongPasswordDate.Add(time.Duration(delaySeconds) * time.Second)) {
 			logrus.Infof("Password retry time delay enforced for %s. delay=%d", email, delaySeconds)
+			//the password isn't verified, so this isn't a guess that counts against the client address
+			c.Set("loginFailureReason", "retry-delay")
 			c.JSON(450, gin.H{"message": "Email/password not valid"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
 		}
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password))
-	if err != nil {
+	r := getRealm(c)
+	if !validUserPassword(u, password) {
 		logrus.Infof("Invalid password for %s", email)
 
 		logrus.Debugf("Increment wrong password counters")
-		err = db.Model(&u).UpdateColumn("wrong_password_count", u.WrongPasswordCount+1, "wrong_password_date", time.Now()).Error
+		count, err := registerWrongPassword(u)
 		if err != nil {
 			logrus.Warnf("Couldn't increment wrong password count for %s. err=%s", email, err)
 		}
+		if count == opt.passwordRetriesMax {
+			logrus.Infof("Account %s locked after %d wrong passwords", email, opt.passwordRetriesMax)
+			auditEvent(c, "user.lockout", email, email, true, map[string]interface{}{"wrongPasswordCount": opt.passwordRetriesMax})
+			go sendAccountLockedMail(r, *u, c.ClientIP())
+		}
 
 		c.JSON(450, gin.H{"message": "Email/password not valid"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
@@ -105,23 +117,61 @@ func processLocalPasswordLogin(m map[string]string, c *gin.Context, pmethod stri
 	}
 
 	logrus.Debugf("Reset wrong password counters")
-	err = resetWrongPasswordCounters(u)
+	locked, err := clearWrongPasswords(u)
 	if err != nil {
 		logrus.Warnf("Couldn't zero wrong password count for %s. err=%s", email, err)
 		c.JSON(500, gin.H{"message": "Server error"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 		return
 	}
+	if locked {
+		logrus.Infof("Account %s was locked by concurrent attempts", email)
+		processOutputAccountLocked(u, c, pmethod, ppath)
+		return
+	}
 
-	validateUserAndOutputTokensToResponse(u, c, pmethod, ppath, "password", "")
+	if !processValidateUserApproved(u, c, pmethod, ppath) {
+		return
+	}
+
+	if r.passwordPolicy.ExpireBreached && !u.PasswordResetRequired && passwordBreached(password) {
+		logrus.Infof("Password of %s found in a data breach. Requiring a password reset", email)
+		err := db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("password_reset_required", true).Error
+		if err != nil {
+			logrus.Warnf("Couldn't require password reset for %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		auditEvent(c, "password.breached", email, email, true, nil)
+		c.Set("loginFailureReason", "password-breached")
+		c.JSON(455, gin.H{"message": "Password found in a data breach. Reset your password"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+		return
+	}
+
+	validateUserAndOutputTokensToResponse(r, u, c, pmethod, ppath, "password", "", "", "")
 	logrus.Debugf("Local password login for %s", email)
 }
 
-func processValidateUserActivated(email string, c *gin.Context, pmethod string, ppath string) (*User, bool) {
+func processValidateUserActivated(r *realmInfo, email string, c *gin.Context, pmethod string, ppath string) (*User, bool) {
+	u, success := processLoadLoginUser(r, email, c, pmethod, ppath)
+	if !success || !processValidateUserApproved(u, c, pmethod, ppath) {
+		return nil, false
+	}
+	return u, true
+}
+
+//processLoadLoginUser loads the user of a login. Accounts not activated yet are only returned if pending approval
+func processLoadLoginUser(r *realmInfo, email string, c *gin.Context, pmethod string, ppath string) (*User, bool) {
 	var u User
-	db1 := db.First(&u, "email = ? AND activation_date IS NOT NULL", email)
+	db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
+
+	if db1.Error == nil {
+		c.Set("loginUser", &u)
+	}
 
-	if db1.RecordNotFound() {
+	if db1.RecordNotFound() || (db1.Error == nil && u.ActivationDate == nil && u.ApprovalStatus != "pending") {
 		c.JSON(450, gin.H{"message": "Email/password not valid"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 		return nil, false
@@ -137,11 +187,32 @@ func processValidateUserActivated(email string, c *gin.Context, pmethod string,
 	return &u, true
 }
 
-func validateUserAndOutputTokensToResponse(u *User, c *gin.Context, pmethod string, ppath string, authType string, socialRefreshToken string) {
+func processValidateUserApproved(u *User, c *gin.Context, pmethod string, ppath string) bool {
+	if u.ActivationDate == nil {
+		c.JSON(475, gin.H{"message": "Account pending approval"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "475").Inc()
+		return false
+	}
+	return true
+}
+
+func validateUserAndOutputTokensToResponse(r *realmInfo, u *User, c *gin.Context, pmethod string, ppath string, authType string, socialRefreshToken string, orgID string, sessionID string) {
+	tokensResponse, valid := validateUserAndCreateTokens(r, u, c, pmethod, ppath, authType, socialRefreshToken, orgID, sessionID)
+	if !valid {
+		return
+	}
+	c.JSON(200, tokensResponse)
+	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	logrus.Debugf("Tokens for %s generated and sent to response", u.Name)
+}
+
+//validateUserAndCreateTokens checks the account status, consents, organization and pre-token hook and creates a session with its tokens.
+//Outputs the error to the response and returns false if tokens can't be issued
+func validateUserAndCreateTokens(r *realmInfo, u *User, c *gin.Context, pmethod string, ppath string, authType string, socialRefreshToken string, orgID string, sessionID string) (gin.H, bool) {
 	if u.Enabled == 0 {
 		c.JSON(460, gin.H{"message": "Account disabled"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
-		return
+		return nil, false
 	}
 
 	customAccessTokenClaims := make(map[string]interface{})
@@ -150,28 +221,97 @@ func validateUserAndOutputTokensToResponse(u *User, c *gin.Context, pmethod stri
 	customRefreshTokenClaims := make(map[string]interface{})
 
 	if authType == "password" {
+		if u.PasswordResetRequired {
+			c.JSON(455, gin.H{"message": "Password reset required"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
+			return nil, false
+		}
 		if u.PasswordValidUntil != nil {
 			if u.PasswordValidUntil.Before(time.Now()) {
-				c.JSON(455, gin.H{"message": "Password expired"})
-				invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
-				return
+				processOutputPasswordExpired(r, u, c, pmethod, ppath)
+				return nil, false
 			}
 		}
 
 	}
 
+	accepted, err := loadAcceptedConsents(u.ID)
+	if err == nil {
+		var pending []ConsentDocument
+		pending, err = pendingConsents(r, accepted)
+		if err == nil && len(pending) > 0 {
+			processOutputConsentRequired(r, u, pending, authType, c, pmethod, ppath)
+			return nil, false
+		}
+	}
+	if err != nil {
+		logrus.Warnf("Error verifying consents of %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return nil, false
+	}
+	if len(accepted) > 0 {
+		customAccessTokenClaims["consents"] = accepted
+	}
+
 	if socialRefreshToken != "" {
 		customRefreshTokenClaims["socialToken"] = socialRefreshToken
 	}
 
+	if u.Roles != "" {
+		customAccessTokenClaims["roles"] = strings.Split(u.Roles, ",")
+	}
+
+	if orgID != "" {
+		var mb Membership
+		db1 := membershipsInRealm(r).First(&mb, "memberships.organization_id = ? AND memberships.user_id = ?", orgID, u.ID)
+		if db1.RecordNotFound() {
+			c.JSON(470, gin.H{"message": "Not a member of organization"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+			return nil, false
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting membership of %s in organization %s. err=%s", u.Email, orgID, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return nil, false
+		}
+		scopes := customAccessTokenClaims["scope"].([]string)
+		if mb.Scopes != "" {
+			scopes = append(scopes, strings.Split(mb.Scopes, ",")...)
+		}
+		customAccessTokenClaims["scope"] = scopes
+		customAccessTokenClaims["org_id"] = orgID
+		customAccessTokenClaims["org_role"] = mb.Role
+		customRefreshTokenClaims["org_id"] = orgID
+	}
+
+	hookClaims, valid := processPreTokenHook(r, u, authType, orgID, sessionID != "", c, pmethod, ppath)
+	if !valid {
+		return nil, false
+	}
+	for k, v := range hookClaims {
+		customAccessTokenClaims[k] = v
+	}
+
 	logrus.Debugf("User %s authenticated and validated", u.Email)
 
-	tokensResponse, err := createAccessAndRefreshToken(u.Name, u.Email, authType, customAccessTokenClaims, customRefreshTokenClaims)
+	sid, err := saveSession(u, sessionID, authType, c)
+	if err != nil {
+		logrus.Warnf("Error saving session for user %s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return nil, false
+	}
+	customAccessTokenClaims["sid"] = sid
+	customRefreshTokenClaims["sid"] = sid
+
+	tokensResponse, err := createAccessAndRefreshToken(r, u, authType, customAccessTokenClaims, customRefreshTokenClaims)
 	if err != nil {
 		logrus.Warnf("Error generating tokens for user %s. err=%s", u.Email, err)
 		c.JSON(500, gin.H{"message": "Server error"})
 		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-		return
+		return nil, false
 	}
 
 	err = db.Model(&u).UpdateColumn("last_token_type", authType, "last_token_date", time.Now()).Error
@@ -179,9 +319,7 @@ func validateUserAndOutputTokensToResponse(u *User, c *gin.Context, pmethod stri
 		logrus.Warnf("Couldn't update last_token_type/date for %s. err=%s", u.Email, err)
 	}
 
-	c.JSON(200, tokensResponse)
-	invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
-	logrus.Debugf("Tokens for %s generated and sent to response", u.Name)
+	return tokensResponse, true
 }
 
 //TOKEN REFRESH
@@ -190,21 +328,21 @@ func tokenRefresh() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
-		claims, err := loadAndValidateToken(c.Request, "refresh", "")
+		r := getRealm(c)
+		claims, err := loadAndValidateToken(r, c.Request, "refresh", "")
 		if err != nil {
 			c.JSON(450, gin.H{"message": "Invalid refresh token"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
 		}
 
-		email0, exists := claims["sub"]
+		sub, exists := claims["sub"].(string)
 		if !exists {
 			logrus.Warnf("Refresh token valid but doesn't have 'sub' claim")
 			c.JSON(450, gin.H{"message": "Invalid refresh token"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
 		}
-		email := email0.(string)
 
 		authType0, exists := claims["authType"]
 		if !exists {
@@ -215,22 +353,22 @@ func tokenRefresh() func(*gin.Context) {
 		}
 		authType := authType0.(string)
 
-		logrus.Debugf("Refresh token validated for %s. Verifying user account", email)
+		logrus.Debugf("Refresh token validated for %s. Verifying user account", sub)
 
-		var u User
-		db1 := db.First(&u, "email = ? AND activation_date IS NOT NULL", email)
-		if db1.RecordNotFound() {
+		//sub is the user id, which is kept when the email changes, or the email for realms with legacy token subject
+		u, err := loadTokenUser(r, claims)
+		if gorm.IsRecordNotFoundError(err) || (err == nil && u.ActivationDate == nil) {
 			c.JSON(404, gin.H{"message": "Account not found"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
 			return
 		}
-		err = db1.Error
 		if err != nil {
-			logrus.Warnf("Error getting user during token refresh. email=%s err=%s", email, err)
+			logrus.Warnf("Error getting user during token refresh. sub=%s err=%s", sub, err)
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 			return
 		}
+		email := u.Email
 
 		socialToken := ""
 
@@ -245,12 +383,12 @@ func tokenRefresh() func(*gin.Context) {
 			socialToken = socialToken0.(string)
 
 			if authType == "facebook" {
-				temail, _, success := processFacebookToken(c, socialToken, pmethod, ppath)
+				temail, _, _, success := processFacebookToken(c, socialToken, pmethod, ppath)
 				if !success {
 					return
 				}
 
-				socialToken1, success := processFacebookRefreshToken(c, socialToken, pmethod, ppath)
+				socialToken1, success := processFacebookRefreshToken(r, c, socialToken, pmethod, ppath)
 				if !success {
 					return
 				}
@@ -264,7 +402,7 @@ func tokenRefresh() func(*gin.Context) {
 				}
 
 			} else if authType == "google" {
-				temail, _, success := processGoogleRefreshToken(c, socialToken, pmethod, ppath)
+				temail, _, _, success := processGoogleRefreshToken(r, c, socialToken, pmethod, ppath)
 				if !success {
 					return
 				}
@@ -276,11 +414,18 @@ func tokenRefresh() func(*gin.Context) {
 					return
 				}
 
-				logrus.Debugf("Google refresh token valid for %s. Checking if account already exists")
+				logrus.Debugf("Google refresh token valid for %s. Checking if account already exists", email)
 			}
 		}
 
-		validateUserAndOutputTokensToResponse(&u, c, pmethod, ppath, authType, socialToken)
+		orgID, _ := claims["org_id"].(string)
+
+		sid, valid := processValidateSession(claims, &u, c, pmethod, ppath)
+		if !valid {
+			return
+		}
+
+		validateUserAndOutputTokensToResponse(r, &u, c, pmethod, ppath, authType, socialToken, orgID, sid)
 		logrus.Debugf("Token refresh for %s", email)
 	}
 }
@@ -291,7 +436,8 @@ func tokenInfo() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
-		claims, err := loadAndValidateToken(c.Request, "", "")
+		r := getRealm(c)
+		claims, err := loadAndValidateToken(r, c.Request, "", "")
 		if err != nil {
 			logrus.Debugf("Invalid token. err=%s", err)
 			c.JSON(450, gin.H{"message": "Invalid token"})
@@ -299,23 +445,28 @@ func tokenInfo() func(*gin.Context) {
 			return
 		}
 
-		email, exists := claims["sub"]
-		if !exists {
+		sub, _ := claims["sub"].(string)
+		if sub == "" {
 			logrus.Debugf("Invalid token. 'sub' claim not found")
 			c.JSON(450, gin.H{"message": "Invalid token"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
 			return
 		}
 
-		var u User
-		db1 := db.First(&u, "email = ? AND enabled = 1", email)
-
-		if db1.RecordNotFound() {
+		u, err := loadTokenUser(r, claims)
+		if gorm.IsRecordNotFoundError(err) || (err == nil && u.Enabled == 0) {
 			c.JSON(455, gin.H{"message": "User not enabled"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
 			return
-
 		}
+		if err != nil {
+			logrus.Warnf("Error finding user %s. err=%s", sub, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		email := u.Email
 
 		typ, exists1 := claims["typ"]
 		if !exists1 {
@@ -330,13 +481,6 @@ func tokenInfo() func(*gin.Context) {
 			return
 		}
 
-		if db1.Error != nil {
-			logrus.Warnf("Error finding user %s. err=%s", email, db1.Error)
-			c.JSON(500, gin.H{"message": "Server error"})
-			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-			return
-		}
-
 		c.JSON(200, claims)
 		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
 		logrus.Debugf("Token info for %s", email)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,14 +10,23 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func (h *HTTPServer) setupUserHandlers() {
-	h.router.PUT("/user/:email", createUser())
-	h.router.POST("/user/:email/activate", activateUser())
-	// h.router.POST("/user/:email/disable", disableUser())
+const activationCodeMaxTries = 5
+
+const emailValidationRegex = "^(([^<>()\\[\\]\\.,;:\\s@\"]+(\\.[^<>()\\[\\]\\.,;:\\s@\"]+)*)|(\".+\"))@(([^<>()[\\]\\.,;:\\s@\"]+\\.)+[^<>()[\\]\\.,;:\\s@\"]{2,})$"
+
+func (h *HTTPServer) setupUserHandlers(rg *gin.RouterGroup) {
+	rg.PUT("/user/:email", createUser())
+	rg.POST("/user/:email/activate", activateUser())
+	rg.POST("/user/:email/activation-resend", activationResend())
+	rg.GET("/admin/approval", adminApprovalList())
+	rg.POST("/admin/user/:email/approve", adminUserApprove())
+	rg.POST("/admin/user/:email/reject", adminUserReject())
+	// rg.POST("/user/:email/disable", disableUser())
 }
 
 func createUser() func(*gin.Context) {
@@ -24,8 +34,9 @@ func createUser() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
+		r := getRealm(c)
 		email := strings.ToLower(c.Param("email"))
-		logrus.Debugf("createUser email=%s", email)
+		logrus.Debugf("createUser email=%s realm=%s", email, r.Name)
 
 		m := make(map[string]string)
 		data, _ := ioutil.ReadAll(c.Request.Body)
@@ -38,7 +49,7 @@ func createUser() func(*gin.Context) {
 		m["email"] = email
 
 		//VALIDATE INPUTS
-		valid := validateField(m, "email", "^(([^<>()\\[\\]\\.,;:\\s@\"]+(\\.[^<>()\\[\\]\\.,;:\\s@\"]+)*)|(\".+\"))@(([^<>()[\\]\\.,;:\\s@\"]+\\.)+[^<>()[\\]\\.,;:\\s@\"]{2,})$")
+		valid := validateField(m, "email", emailValidationRegex)
 		if !valid {
 			c.JSON(455, gin.H{"message": "Invalid email"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "455").Inc()
@@ -52,35 +63,73 @@ func createUser() func(*gin.Context) {
 			return
 		}
 
-		valid = validateField(m, "password", opt.passwordValidationRegex)
-		if !valid {
-			c.JSON(460, gin.H{"message": "Invalid password"})
+		violations := validatePassword(r, m["password"], email, m["name"])
+		if len(violations) > 0 {
+			c.JSON(460, gin.H{"message": "Invalid password", "violations": violations})
 			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
 			return
 		}
 
+		//VERIFY INVITATION
+		var inv *Invitation
+		_, hasToken := c.Request.Header["Authorization"]
+		if hasToken || r.SignupMethod == "invitation" {
+			inv, valid, err = loadInvitationFromToken(r, c.Request, email)
+			if err != nil {
+				logrus.Warnf("Error getting invitation for %s. err=%s", email, err)
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+			if !valid {
+				c.JSON(470, gin.H{"message": "Valid invitation required"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+				return
+			}
+		}
+
+		//VERIFY CONSENTS
+		consentDocs, valid := processParseConsents(r, m["consents"], c, pmethod, ppath)
+		if !valid {
+			return
+		}
+		accepted := make(map[string]int)
+		for _, doc := range consentDocs {
+			accepted[doc.Name] = doc.Version
+		}
+		pending, err := pendingConsents(r, accepted)
+		if err != nil {
+			logrus.Warnf("Error verifying consents for %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if len(pending) > 0 {
+			c.JSON(480, gin.H{"message": "Consent required", "documents": pending})
+			invocationCounter.WithLabelValues(pmethod, ppath, "480").Inc()
+			return
+		}
+
+		if !processPreSignupHook(r, email, m["name"], "password", c, pmethod, ppath) {
+			return
+		}
+
 		//VERIFY IF EMAIL ALREADY EXISTS
 		var u User
-		if !db.First(&u, "email = ?", email).RecordNotFound() {
-			if u.ActivationDate != nil {
+		replaced := false
+		if !db.First(&u, "realm = ? AND email = ?", r.Name, email).RecordNotFound() {
+			if !isUnverifiedSignup(r, &u) {
 				c.JSON(465, gin.H{"message": "Email already registered"})
 				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
 				return
 			}
-
 			logrus.Infof("New account registration with existing email in pending activation state. Replacing it.")
-			err := db.Unscoped().Delete(&u).Error
-			if err != nil {
-				logrus.Warnf("Couldn't delete user email=%s. err=%s", email, err)
-				c.JSON(500, gin.H{"message": "Server error"})
-				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
-				return
-			}
+			replaced = true
 		}
 
 		//CREATE ACCOUNT
 		pwd := m["password"]
-		phash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.MinCost)
+		phash, err := hashPassword(pwd)
 		if err != nil {
 			logrus.Warnf("Couldn't hash password for email=%s. err=%s", email, err)
 			c.JSON(500, gin.H{"message": "Server error"})
@@ -89,64 +138,226 @@ func createUser() func(*gin.Context) {
 		}
 
 		u0 := User{
+			ID:                 uuid.New().String(),
+			Realm:              r.Name,
 			Email:              email,
 			Enabled:            1,
 			CreationDate:       time.Now(),
 			Name:               m["name"],
 			PasswordDate:       time.Now(),
-			PasswordHash:       string(phash),
+			PasswordHash:       phash,
 			ActivationDate:     nil,
 			PasswordValidUntil: generatePasswordValidUntil(),
 		}
-		if opt.accountActivationMethod == "direct" {
+		//invitation mails already proved email ownership
+		if inv != nil {
 			now := time.Now()
 			u0.ActivationDate = &now
+		} else {
+			initAccountActivation(r, &u0, false)
 		}
-		err = db.Create(&u0).Error
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if replaced {
+				err := deleteUnactivatedUser(tx, &u)
+				if err != nil {
+					return err
+				}
+			}
+			err := tx.Create(&u0).Error
+			if err != nil {
+				return err
+			}
+			err = savePasswordHistory(tx, &u0, phash)
+			if err != nil {
+				return err
+			}
+			err = saveOutboxEvent(tx, r.Name, "user.created", userWebhookData(&u0))
+			if err != nil {
+				return err
+			}
+			err = recordConsents(tx, &u0, consentDocs, c.ClientIP())
+			if err != nil || inv == nil {
+				return err
+			}
+			return applyInvitation(tx, inv, &u0)
+		})
 		if err != nil {
 			logrus.Warnf("Error creating user email=%s. err=%s", email, err)
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 			return
 		}
+		auditEvent(c, "user.signup", email, email, true, map[string]interface{}{"authType": "password"})
+		if replaced {
+			emitWebhookEvent(r.Name, "user.deleted", map[string]interface{}{"id": u.ID})
+		}
+		emitWebhookEvent(r.Name, "user.created", userWebhookData(&u0))
 
-		if opt.accountActivationMethod == "direct" {
+		if u0.ActivationDate != nil {
 			c.JSON(201, gin.H{"message": "Account created and activated"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "201").Inc()
 			return
 		}
 
+		if r.AccountActivationMethod == "approval" {
+			logrus.Infof("Account %s created and pending approval", email)
+			c.JSON(251, gin.H{"message": "Account created and pending approval"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "251").Inc()
+			return
+		}
+
 		//SEND ACTIVATION TOKEN TO USER EMAIL
-		_, activationTokenString, err := createJWTToken(email, opt.validationTokenExpirationMinutes, "activation", "password", nil)
-		if err != nil {
-			logrus.Warnf("Error creating activation token for email=%s. err=%s", email, err)
+		if !processSendActivationMail(r, &u0, c, pmethod, ppath) {
+			return
+		}
+		logrus.Debugf("Account created and activation link sent to email %s", email)
+		c.JSON(250, gin.H{"message": "Account created and activation link sent to email"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "250").Inc()
+	}
+}
+
+//isUnverifiedSignup tells whether an account is still waiting for its e-mail to be verified, so a new signup may replace it. Accounts waiting for approval are kept
+func isUnverifiedSignup(r *realmInfo, u *User) bool {
+	if u.ActivationDate != nil || u.MailVerifiedDate != nil {
+		return false
+	}
+	return u.ApprovalStatus != "pending" || r.AccountActivationMethod == "mail+approval"
+}
+
+//initAccountActivation activates a new account or leaves it pending approval, according to the realm activation method.
+//mailVerified tells if the email ownership was already proved (as in social logins), so no activation mail is needed
+func initAccountActivation(r *realmInfo, u *User, mailVerified bool) {
+	now := time.Now()
+	if mailVerified {
+		u.MailVerifiedDate = &now
+	}
+	if strings.HasSuffix(r.AccountActivationMethod, "approval") {
+		u.ApprovalStatus = "pending"
+	} else if r.AccountActivationMethod == "direct" || mailVerified {
+		u.ActivationDate = &now
+	}
+}
+
+//processSendActivationMail mails a new activation JWT or code, depending on the realm activation token format
+func processSendActivationMail(r *realmInfo, u *User, c *gin.Context, pmethod string, ppath string) bool {
+	var activationTokenString string
+	var err error
+	now := time.Now()
+	updates := map[string]interface{}{"activation_mail_date": now, "activation_code_hash": "", "activation_code_tries": 0}
+	if r.ActivationTokenFormat == "code" {
+		activationTokenString, err = generateNumericCode(6)
+		updates["activation_code_hash"] = hashActivationCode(activationTokenString)
+	} else {
+		_, activationTokenString, err = createJWTToken(r, u.Email, opt.validationTokenExpirationMinutes, "activation", "password", nil)
+	}
+	if err != nil {
+		logrus.Warnf("Error creating activation token for email=%s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+
+	err = db.Model(u).UpdateColumns(updates).Error
+	if err != nil {
+		logrus.Warnf("Error registering activation mail for email=%s. err=%s", u.Email, err)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+
+	logrus.Debugf("Sending activation mail to %s", u.Email)
+	subject, htmlBody, _ := r.mailTemplate("activation")
+	htmlBody = strings.ReplaceAll(htmlBody, "EMAIL", u.Email)
+	htmlBody = strings.ReplaceAll(htmlBody, "DISPLAY_NAME", u.Name)
+	htmlBody = strings.ReplaceAll(htmlBody, "ACTIVATION_TOKEN", activationTokenString)
+	err = sendMail(r, subject, htmlBody, u.Email, u.Name)
+	if err != nil {
+		logrus.Warnf("Couldn't send account validation email to %s (%s). err=%s", u.Email, subject, err)
+		mailCounter.WithLabelValues("POST", "activation", "500").Inc()
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+
+	mailCounter.WithLabelValues("POST", "activation", "202").Inc()
+	if opt.mailTokensTests == "true" {
+		logrus.Warnf("ADDING ACTIVATION TOKEN TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
+		c.Header("Test-Token", activationTokenString)
+	}
+	return true
+}
+
+//processValidateActivationCode checks the mailed activation code. Codes are invalidated after a few tries.
+//Each try is counted atomically before comparing the code, so concurrent guesses can't exceed the limit
+func processValidateActivationCode(u *User, code string, c *gin.Context, pmethod string, ppath string) bool {
+	expired := u.ActivationMailDate == nil || time.Since(*u.ActivationMailDate) > time.Duration(opt.validationTokenExpirationMinutes)*time.Minute
+	if u.ActivationCodeHash == "" || expired {
+		c.JSON(450, gin.H{"message": "Invalid activation code"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return false
+	}
+
+	db1 := db.Model(&User{}).Where("id = ? AND activation_code_tries < ?", u.ID, activationCodeMaxTries).UpdateColumn("activation_code_tries", gorm.Expr("activation_code_tries + 1"))
+	if db1.Error != nil {
+		logrus.Warnf("Couldn't increment activation code tries for %s. err=%s", u.Email, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return false
+	}
+	if db1.RowsAffected == 0 {
+		logrus.Infof("Max activation code tries reached for %s", u.Email)
+		c.JSON(450, gin.H{"message": "Invalid activation code"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(u.ActivationCodeHash), []byte(hashActivationCode(code))) != 1 {
+		logrus.Infof("Wrong activation code for %s", u.Email)
+		c.JSON(450, gin.H{"message": "Invalid activation code"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return false
+	}
+	return true
+}
+
+func activationResend() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("activationResend email=%s", email)
+
+		var u User
+		db1 := db.First(&u, "realm = ? AND email = ? AND enabled = 1 AND activation_date IS NULL AND mail_verified_date IS NULL", r.Name, email)
+		if db1.RecordNotFound() || !strings.HasPrefix(r.AccountActivationMethod, "mail") {
+			//we don't want to give clues about existing accounts to abusers
+			logrus.Infof("Activation resend requested for %s, but there is no account pending mail activation", email)
+			c.JSON(202, gin.H{"message": "Activation mail resent"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+			return
+		}
+		if db1.Error != nil {
+			logrus.Warnf("Error getting user %s. err=%s", email, db1.Error)
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 			return
 		}
 
-		logrus.Debugf("Sending activation mail to %s", email)
-		htmlBody := strings.ReplaceAll(opt.mailActivationHTMLBody, "EMAIL", u0.Email)
-		htmlBody = strings.ReplaceAll(htmlBody, "DISPLAY_NAME", u0.Name)
-		htmlBody = strings.ReplaceAll(htmlBody, "ACTIVATION_TOKEN", activationTokenString)
-		err = sendMail(opt.mailActivationSubject, htmlBody, email, u0.Name)
-		if err != nil {
-			logrus.Warnf("Couldn't send account validation email to %s (%s). err=%s", email, opt.mailActivationSubject, err)
-			mailCounter.WithLabelValues("POST", "activation", "500").Inc()
-			c.JSON(500, gin.H{"message": "Server error"})
+		if u.ActivationMailDate != nil && time.Since(*u.ActivationMailDate) < time.Duration(opt.activationResendIntervalSeconds)*time.Second {
+			logrus.Infof("Activation resend for %s rate limited", email)
+			c.JSON(429, gin.H{"message": "Activation mail sent recently. Try again later"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "429").Inc()
 			return
 		}
 
-		logrus.Debugf("Account created and activation link sent to email %s", email)
-		// logrus.Debugf("Activation token=%s", activationTokenString)
-		mailCounter.WithLabelValues("POST", "activation", "202").Inc()
-		if opt.mailTokensTests == "true" {
-			logrus.Warnf("ADDING ACTIVATION TOKEN TO RESPONSE HEADER. NEVER USE THIS IN PRODUCTION. DISABLE THIS BY REMOVING ENV 'MAIL_TOKENS_FOR_TESTS'")
-			c.Header("Test-Token", activationTokenString)
+		if !processSendActivationMail(r, &u, c, pmethod, ppath) {
+			return
 		}
-		c.JSON(250, gin.H{"message": "Account created and activation link sent to email"})
-		invocationCounter.WithLabelValues(pmethod, ppath, "250").Inc()
-		return
+		logrus.Debugf("Activation mail resent to %s", email)
+		c.JSON(202, gin.H{"message": "Activation mail resent"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
 	}
 }
 
@@ -156,24 +367,45 @@ func activateUser() func(*gin.Context) {
 		pmethod := c.Request.Method
 		ppath := c.FullPath()
 
+		r := getRealm(c)
 		email := strings.ToLower(c.Param("email"))
 		logrus.Debugf("activateUser email=%s", email)
 
-		_, err := loadAndValidateToken(c.Request, "activation", email)
-		if err != nil {
-			c.JSON(450, gin.H{"message": "Invalid activation token"})
-			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
-			return
+		//activation may be done with the mailed JWT token or with the mailed code
+		code := ""
+		_, hasToken := c.Request.Header["Authorization"]
+		if hasToken {
+			_, err := loadAndValidateToken(r, c.Request, "activation", email)
+			if err != nil {
+				c.JSON(450, gin.H{"message": "Invalid activation token"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+				return
+			}
+		} else {
+			m := make(map[string]string)
+			data, _ := ioutil.ReadAll(c.Request.Body)
+			json.Unmarshal(data, &m)
+			code = m["code"]
+			if code == "" {
+				c.JSON(450, gin.H{"message": "Invalid activation token"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+				return
+			}
 		}
 
 		var u User
-		db1 := db.First(&u, "email = ?", email)
+		db1 := db.First(&u, "realm = ? AND email = ?", r.Name, email)
+		if db1.RecordNotFound() && code != "" {
+			c.JSON(450, gin.H{"message": "Invalid activation code"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
 		if db1.RecordNotFound() {
 			c.JSON(404, gin.H{"message": "Account not found"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
 			return
 		}
-		err = db1.Error
+		err := db1.Error
 		if err != nil {
 			logrus.Warnf("Error getting user during activation. email=%s err=%s", email, err)
 			c.JSON(500, gin.H{"message": "Server error"})
@@ -193,7 +425,32 @@ func activateUser() func(*gin.Context) {
 			return
 		}
 
-		err = db.Model(&u).UpdateColumn("activationDate", time.Now()).Error
+		if code != "" && !processValidateActivationCode(&u, code, c, pmethod, ppath) {
+			return
+		}
+
+		if u.ApprovalStatus == "pending" {
+			err = db.Model(&u).UpdateColumns(map[string]interface{}{"mail_verified_date": time.Now(), "activation_code_hash": ""}).Error
+			if err != nil {
+				logrus.Warnf("Error verifying user mail. email=%s err=%s", email, err)
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+			c.JSON(251, gin.H{"message": "Email verified. Account pending approval"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "251").Inc()
+			logrus.Debugf("Account %s email verified. Pending approval", email)
+			return
+		}
+
+		now := time.Now()
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(&u).UpdateColumns(map[string]interface{}{"activationDate": now, "mail_verified_date": now, "activation_code_hash": ""}).Error
+			if err != nil {
+				return err
+			}
+			return saveOutboxEvent(tx, r.Name, "user.activated", userWebhookData(&u))
+		})
 		if err != nil {
 			logrus.Warnf("Error activating user. email=%s err=%s", email, err)
 			c.JSON(500, gin.H{"message": "Server error"})
@@ -201,20 +458,181 @@ func activateUser() func(*gin.Context) {
 			return
 		}
 
+		auditEvent(c, "user.activate", email, email, true, nil)
+		emitWebhookEvent(r.Name, "user.activated", userWebhookData(&u))
+		logrus.Debugf("Account %s activated successfuly", email)
+
 		//ACCOUNT ACTIVATED. CREATE ACCESS TOKENS FOR DIRECT SIGNIN
-		defaultAccessClaims := make(map[string]interface{})
-		defaultAccessClaims["scope"] = strings.Split(opt.accessTokenDefaultScope, ",")
-		tokensResponse, err := createAccessAndRefreshToken(u.Name, email, "password", defaultAccessClaims, nil)
+		tokensResponse, valid := validateUserAndCreateTokens(r, &u, c, pmethod, ppath, "password", "", "", "")
+		if !valid {
+			return
+		}
+		tokensResponse["message"] = "Account activated successfuly"
+		c.JSON(202, tokensResponse)
+		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+	}
+}
+
+func adminApprovalList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
 		if err != nil {
-			logrus.Warnf("Error generating tokens for user %s. err=%s", email, err)
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		users := make([]User, 0)
+		err = db.Order("creation_date").Find(&users, "realm = ? AND approval_status = 'pending'", r.Name).Error
+		if err != nil {
+			logrus.Warnf("Error listing pending accounts. err=%s", err)
 			c.JSON(500, gin.H{"message": "Server error"})
 			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
 			return
 		}
 
-		tokensResponse["message"] = "Account activated successfuly"
-		c.JSON(202, tokensResponse)
-		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
-		logrus.Debugf("Account %s activated successfuly", email)
+		result := make([]gin.H, 0)
+		for _, u := range users {
+			result = append(result, gin.H{
+				"email":            u.Email,
+				"name":             u.Name,
+				"creationDate":     u.CreationDate,
+				"mailVerifiedDate": u.MailVerifiedDate,
+			})
+		}
+		c.JSON(200, result)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminUserApprove() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminUserApprove email=%s", email)
+
+		u, success := processLoadPendingApprovalUser(r, email, c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		//with 'mail+approval' the account is activated only after its mail is verified too
+		updates := map[string]interface{}{"approval_status": "approved"}
+		if u.MailVerifiedDate != nil || r.AccountActivationMethod != "mail+approval" {
+			updates["activation_date"] = time.Now()
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Model(u).UpdateColumns(updates).Error
+			if err != nil || updates["activation_date"] == nil {
+				return err
+			}
+			return saveOutboxEvent(tx, r.Name, "user.activated", userWebhookData(u))
+		})
+		if err != nil {
+			logrus.Warnf("Error approving user %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if updates["activation_date"] != nil {
+			emitWebhookEvent(r.Name, "user.activated", userWebhookData(u))
+		}
+
+		err = sendAccountNotificationMail(r, "approval", u)
+		if err != nil {
+			logrus.Warnf("Couldn't send approval email to %s. err=%s", email, err)
+		}
+
+		logrus.Infof("Account %s approved", email)
+		c.JSON(200, gin.H{"message": "Account approved"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminUserReject() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		email := strings.ToLower(c.Param("email"))
+		logrus.Debugf("adminUserReject email=%s", email)
+
+		u, success := processLoadPendingApprovalUser(r, email, c, pmethod, ppath)
+		if !success {
+			return
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return deleteUnactivatedUser(tx, u)
+		})
+		if err != nil {
+			logrus.Warnf("Error deleting rejected user %s. err=%s", email, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		emitWebhookEvent(r.Name, "user.deleted", map[string]interface{}{"id": u.ID})
+
+		err = sendAccountNotificationMail(r, "rejection", u)
+		if err != nil {
+			logrus.Warnf("Couldn't send rejection email to %s. err=%s", email, err)
+		}
+
+		logrus.Infof("Account %s rejected", email)
+		c.JSON(200, gin.H{"message": "Account rejected"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func processLoadPendingApprovalUser(r *realmInfo, email string, c *gin.Context, pmethod string, ppath string) (*User, bool) {
+	_, err := loadAndValidateMasterToken(c.Request)
+	if err != nil {
+		logrus.Debugf("Invalid master token. err=%s", err)
+		c.JSON(450, gin.H{"message": "Invalid master token"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+		return nil, false
+	}
+
+	var u User
+	db1 := db.First(&u, "realm = ? AND email = ? AND approval_status = 'pending'", r.Name, email)
+	if db1.RecordNotFound() {
+		c.JSON(404, gin.H{"message": "Account pending approval not found"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+		return nil, false
+	}
+	if db1.Error != nil {
+		logrus.Warnf("Error getting user %s. err=%s", email, db1.Error)
+		c.JSON(500, gin.H{"message": "Server error"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+		return nil, false
+	}
+	return &u, true
+}
+
+//sendAccountNotificationMail sends a realm mail template with EMAIL and DISPLAY_NAME placeholders to the user
+func sendAccountNotificationMail(r *realmInfo, templateName string, u *User) error {
+	subject, htmlBody, ok := r.mailTemplate(templateName)
+	if !ok {
+		return fmt.Errorf("Mail template '%s' not configured for realm %s", templateName, r.Name)
+	}
+	htmlBody = renderMailTemplate(htmlBody,
+		"EMAIL", u.Email,
+		"DISPLAY_NAME", u.Name)
+	err := sendMail(r, subject, htmlBody, u.Email, u.Name)
+	if err != nil {
+		mailCounter.WithLabelValues("POST", templateName, "500").Inc()
+		return err
 	}
+	mailCounter.WithLabelValues("POST", templateName, "202").Inc()
+	return nil
 }
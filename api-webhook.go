@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+//webhookEventTypes are the events that can be subscribed by webhooks. '*' subscribes all of them
+var webhookEventTypes = []string{"user.created", "user.activated", "user.disabled", "user.deleted", "user.email-changed", "password.changed", "login.failed"}
+
+//webhookWakeup makes the delivery worker run right after new events are queued
+var webhookWakeup = make(chan bool, 1)
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *HTTPServer) setupWebhookHandlers(rg *gin.RouterGroup) {
+	rg.POST("/admin/webhook", adminWebhookCreate())
+	rg.GET("/admin/webhook", adminWebhookList())
+	rg.DELETE("/admin/webhook/:id", adminWebhookDelete())
+	rg.GET("/admin/webhook/dead-letter", adminWebhookDeadLetterList())
+	rg.POST("/admin/webhook/dead-letter/:id/retry", adminWebhookDeadLetterRetry())
+}
+
+func adminWebhookCreate() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		m := make(map[string]string)
+		data, _ := ioutil.ReadAll(c.Request.Body)
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			c.JSON(400, gin.H{"message": fmt.Sprintf("Couldn't parse body contents. err=%s", err)})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		u, err := url.Parse(m["url"])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(m["url"]) > 255 {
+			c.JSON(460, gin.H{"message": "Invalid url"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "460").Inc()
+			return
+		}
+
+		events := m["events"]
+		if events == "" {
+			events = "*"
+		}
+		for _, e := range strings.Split(events, ",") {
+			if e != "*" && !isOneOf(e, webhookEventTypes) {
+				c.JSON(465, gin.H{"message": fmt.Sprintf("Invalid event '%s'. Must be '*' or one of %s", e, strings.Join(webhookEventTypes, ", "))})
+				invocationCounter.WithLabelValues(pmethod, ppath, "465").Inc()
+				return
+			}
+		}
+
+		secret := m["secret"]
+		if secret == "" {
+			b := make([]byte, 32)
+			_, err = rand.Read(b)
+			if err != nil {
+				logrus.Warnf("Couldn't generate webhook secret. err=%s", err)
+				c.JSON(500, gin.H{"message": "Server error"})
+				invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+				return
+			}
+			secret = hex.EncodeToString(b)
+		} else if len(secret) < 16 || len(secret) > 100 {
+			c.JSON(470, gin.H{"message": "Invalid secret. Must have 16 to 100 characters"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "470").Inc()
+			return
+		}
+
+		wh := Webhook{
+			ID:           uuid.New().String(),
+			Realm:        r.Name,
+			URL:          m["url"],
+			Secret:       secret,
+			Events:       events,
+			CreationDate: time.Now(),
+		}
+		err = db.Create(&wh).Error
+		if err != nil {
+			logrus.Warnf("Error creating webhook %s. err=%s", wh.URL, err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		logrus.Infof("Webhook %s created for %s. events=%s", wh.ID, wh.URL, wh.Events)
+		c.JSON(201, gin.H{"id": wh.ID, "url": wh.URL, "events": wh.Events, "secret": secret})
+		invocationCounter.WithLabelValues(pmethod, ppath, "201").Inc()
+	}
+}
+
+func adminWebhookList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		whs := make([]Webhook, 0)
+		err = db.Order("creation_date").Find(&whs, "realm = ?", r.Name).Error
+		if err != nil {
+			logrus.Warnf("Error listing webhooks. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, whs)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminWebhookDelete() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		id := c.Param("id")
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		db1 := db.Delete(Webhook{}, "realm = ? AND id = ?", r.Name, id)
+		if db1.Error != nil {
+			logrus.Warnf("Error deleting webhook %s. err=%s", id, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if db1.RowsAffected == 0 {
+			c.JSON(404, gin.H{"message": "Webhook not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		err = db.Delete(WebhookDelivery{}, "webhook_id = ?", id).Error
+		if err != nil {
+			logrus.Warnf("Couldn't delete deliveries of webhook %s. err=%s", id, err)
+		}
+
+		logrus.Infof("Webhook %s deleted", id)
+		c.JSON(200, gin.H{"message": "Webhook deleted"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminWebhookDeadLetterList() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+		if err != nil || limit < 1 || limit > 1000 {
+			c.JSON(400, gin.H{"message": "Invalid limit. Must be between 1 and 1000"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "400").Inc()
+			return
+		}
+
+		q := db.Where("realm = ? AND status = ?", r.Name, "dead")
+		if c.Query("webhookId") != "" {
+			q = q.Where("webhook_id = ?", c.Query("webhookId"))
+		}
+		ds := make([]WebhookDelivery, 0)
+		err = q.Order("creation_date DESC").Limit(limit).Find(&ds).Error
+		if err != nil {
+			logrus.Warnf("Error listing dead webhook deliveries. err=%s", err)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+
+		c.JSON(200, ds)
+		invocationCounter.WithLabelValues(pmethod, ppath, "200").Inc()
+	}
+}
+
+func adminWebhookDeadLetterRetry() func(*gin.Context) {
+	return func(c *gin.Context) {
+		pmethod := c.Request.Method
+		ppath := c.FullPath()
+
+		r := getRealm(c)
+		id := c.Param("id")
+
+		_, err := loadAndValidateMasterToken(c.Request)
+		if err != nil {
+			logrus.Debugf("Invalid master token. err=%s", err)
+			c.JSON(450, gin.H{"message": "Invalid master token"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "450").Inc()
+			return
+		}
+
+		db1 := db.Model(&WebhookDelivery{}).Where("realm = ? AND id = ? AND status = ?", r.Name, id, "dead").Updates(map[string]interface{}{
+			"status":            "pending",
+			"attempts":          0,
+			"next_attempt_date": time.Now(),
+		})
+		if db1.Error != nil {
+			logrus.Warnf("Error requeuing webhook delivery %s. err=%s", id, db1.Error)
+			c.JSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "500").Inc()
+			return
+		}
+		if db1.RowsAffected == 0 {
+			c.JSON(404, gin.H{"message": "Dead delivery not found"})
+			invocationCounter.WithLabelValues(pmethod, ppath, "404").Inc()
+			return
+		}
+		wakeupWebhookWorker()
+
+		logrus.Infof("Webhook delivery %s requeued", id)
+		c.JSON(202, gin.H{"message": "Delivery requeued"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "202").Inc()
+	}
+}
+
+//emitWebhookEvent queues an event for asynchronous delivery to all webhooks of the realm subscribed to its type
+func emitWebhookEvent(realm string, eventType string, data map[string]interface{}) {
+	whs := make([]Webhook, 0)
+	err := db.Find(&whs, "realm = ?", realm).Error
+	if err != nil {
+		logrus.Warnf("Couldn't load webhooks for event %s. err=%s", eventType, err)
+		return
+	}
+
+	now := time.Now()
+	eventID := uuid.New().String()
+	payload, err := json.Marshal(gin.H{"id": eventID, "type": eventType, "realm": realm, "date": now.Format(time.RFC3339), "data": data})
+	if err != nil {
+		logrus.Warnf("Couldn't marshal webhook event %s. err=%s", eventType, err)
+		return
+	}
+
+	queued := false
+	for _, wh := range whs {
+		events := strings.Split(wh.Events, ",")
+		if !isOneOf("*", events) && !isOneOf(eventType, events) {
+			continue
+		}
+		d := WebhookDelivery{
+			ID:              uuid.New().String(),
+			Realm:           realm,
+			WebhookID:       wh.ID,
+			EventID:         eventID,
+			EventType:       eventType,
+			Payload:         string(payload),
+			Status:          "pending",
+			NextAttemptDate: now,
+			CreationDate:    now,
+		}
+		err = db.Create(&d).Error
+		if err != nil {
+			logrus.Warnf("Couldn't queue event %s for webhook %s. err=%s", eventType, wh.ID, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		wakeupWebhookWorker()
+	}
+}
+
+//userWebhookData is the 'data' of user events. Never includes secrets
+func userWebhookData(u *User) map[string]interface{} {
+	return map[string]interface{}{"id": u.ID, "email": u.Email, "name": u.Name}
+}
+
+func wakeupWebhookWorker() {
+	select {
+	case webhookWakeup <- true:
+	default:
+	}
+}
+
+//runWebhookDeliveryWorker delivers pending events. Failed deliveries are retried with exponential backoff until WEBHOOK_MAX_ATTEMPTS, when they go to the dead letter
+func runWebhookDeliveryWorker() {
+	for {
+		ds := make([]WebhookDelivery, 0)
+		err := db.Order("next_attempt_date").Limit(100).Find(&ds, "status = ? AND next_attempt_date <= ?", "pending", time.Now()).Error
+		if err != nil {
+			logrus.Warnf("Couldn't load pending webhook deliveries. err=%s", err)
+		}
+		for _, d := range ds {
+			deliverWebhookEvent(d)
+		}
+		if len(ds) == 100 {
+			continue
+		}
+
+		cleanupDate := time.Now().Add(-7 * 24 * time.Hour)
+		err = db.Delete(WebhookDelivery{}, "status = ? AND creation_date < ?", "delivered", cleanupDate).Error
+		if err != nil {
+			logrus.Warnf("Couldn't remove old webhook deliveries. err=%s", err)
+		}
+
+		select {
+		case <-webhookWakeup:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func deliverWebhookEvent(d WebhookDelivery) {
+	//claim the delivery so that other userme instances won't send it concurrently
+	now := time.Now()
+	db1 := db.Model(&WebhookDelivery{}).Where("id = ? AND status = ? AND next_attempt_date = ?", d.ID, "pending", d.NextAttemptDate).UpdateColumn("next_attempt_date", now.Add(1*time.Minute))
+	if db1.Error != nil || db1.RowsAffected == 0 {
+		return
+	}
+
+	var wh Webhook
+	err := db.First(&wh, "id = ?", d.WebhookID).Error
+	if err != nil {
+		logrus.Debugf("Webhook %s of delivery %s not found. err=%s", d.WebhookID, d.ID, err)
+		db.Delete(WebhookDelivery{}, "id = ?", d.ID)
+		return
+	}
+
+	statusCode, err := postWebhookEvent(&wh, &d)
+	d.Attempts++
+	updates := map[string]interface{}{
+		"attempts":          d.Attempts,
+		"last_attempt_date": now,
+		"last_status_code":  statusCode,
+		"last_error":        "",
+	}
+	if err == nil {
+		logrus.Debugf("Event %s delivered to webhook %s", d.EventType, wh.URL)
+		updates["status"] = "delivered"
+	} else {
+		updates["last_error"] = truncate(err.Error(), 255)
+		if d.Attempts >= opt.webhookMaxAttempts {
+			logrus.Warnf("Delivery of event %s to webhook %s failed %d times. Moved to dead letter. err=%s", d.EventType, wh.URL, d.Attempts, err)
+			updates["status"] = "dead"
+		} else {
+			backoff := time.Duration(float64(opt.webhookRetrySeconds)*math.Pow(2, float64(d.Attempts-1))) * time.Second
+			logrus.Infof("Delivery of event %s to webhook %s failed. Retrying in %s. err=%s", d.EventType, wh.URL, backoff, err)
+			updates["next_attempt_date"] = now.Add(backoff)
+		}
+	}
+	err = db.Model(&WebhookDelivery{}).Where("id = ?", d.ID).Updates(updates).Error
+	if err != nil {
+		logrus.Warnf("Couldn't update webhook delivery %s. err=%s", d.ID, err)
+	}
+}
+
+//postWebhookEvent sends the event payload. The 'X-Userme-Signature' header is 'sha256=' + hex HMAC-SHA256 of '<X-Userme-Timestamp>.<body>' with the webhook secret
+func postWebhookEvent(wh *Webhook, d *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "userme-webhook")
+	req.Header.Set("X-Userme-Event", d.EventType)
+	req.Header.Set("X-Userme-Delivery", d.ID)
+	req.Header.Set("X-Userme-Timestamp", timestamp)
+	req.Header.Set("X-Userme-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(wh.Secret), timestamp+"."+d.Payload)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	//responses are ignored. Drain a bit of the body so the connection may be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
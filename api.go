@@ -27,6 +27,48 @@ var invocationCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	"status",
 })
 
+var eventCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "broker_event_total",
+	Help: "Total domain events published to the event broker",
+}, []string{
+	"type",
+	"status",
+})
+
+var breachedPasswordCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "breached_password_check_total",
+	Help: "Total breached password lookups",
+}, []string{
+	"source",
+	"result",
+})
+
+var passwordRehashCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "password_rehash_total",
+	Help: "Total password hashes upgraded on login",
+}, []string{
+	"algorithm",
+})
+
+var bruteForceFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "brute_force_login_failure_total",
+	Help: "Total failed password logins counted for ip and subnet brute force protection",
+})
+
+var bruteForceRejectedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "brute_force_rejected_total",
+	Help: "Total password logins rejected by ip and subnet brute force protection",
+}, []string{
+	"reason",
+})
+
+var bruteForceBanCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "brute_force_ban_total",
+	Help: "Total ip and subnet bans",
+}, []string{
+	"scope",
+})
+
 var mailCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Name: "mail_sent_total",
 	Help: "Total e-mails sent",
@@ -38,10 +80,13 @@ var mailCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 
 func NewHTTPServer() *HTTPServer {
 	router := gin.Default()
+	//X-Forwarded-For is only honoured for --trusted-proxies
+	router.ForwardedByClientIP = false
+	router.Use(clientIPMiddleware())
 
 	router.Use(cors.Middleware(cors.Config{
 		Origins:         opt.corsAllowedOrigins,
-		Methods:         "GET, POST, PUT",
+		Methods:         "GET, POST, PUT, PATCH, DELETE",
 		RequestHeaders:  "Authorization, Origin, Content-Type, Referer, User-Agent",
 		ExposedHeaders:  "",
 		MaxAge:          24 * 3600 * time.Second,
@@ -49,6 +94,8 @@ func NewHTTPServer() *HTTPServer {
 		ValidateHeaders: false,
 	}))
 
+	router.Use(auditAdminActions())
+
 	h := &HTTPServer{server: &http.Server{
 		Addr:    ":7000",
 		Handler: router,
@@ -56,11 +103,39 @@ func NewHTTPServer() *HTTPServer {
 
 	prometheus.MustRegister(invocationCounter)
 	prometheus.MustRegister(mailCounter)
+	prometheus.MustRegister(eventCounter)
+	prometheus.MustRegister(breachedPasswordCounter)
+	prometheus.MustRegister(passwordRehashCounter)
+	prometheus.MustRegister(bruteForceFailureCounter)
+	prometheus.MustRegister(bruteForceRejectedCounter)
+	prometheus.MustRegister(bruteForceBanCounter)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "brute_force_active_bans",
+		Help: "Active ip and subnet bans",
+	}, countActiveIPBans))
 
 	logrus.Infof("Initializing HTTP Handlers...")
-	h.setupUserHandlers()
-	h.setupTokenHandlers()
-	h.setupPasswordHandlers()
+	//realm handlers are served at root (realm selected by Host header) and under /realm/:realm
+	for _, rg := range []*gin.RouterGroup{router.Group("/", realmMiddleware()), router.Group("/realm/:realm", realmMiddleware())} {
+		h.setupUserHandlers(rg)
+		h.setupTokenHandlers(rg)
+		h.setupPasswordHandlers(rg)
+		h.setupLockoutHandlers(rg)
+		h.setupIPBanHandlers(rg)
+		h.setupOrgHandlers(rg)
+		h.setupInvitationHandlers(rg)
+		h.setupEmailChangeHandlers(rg)
+		h.setupProfileHandlers(rg)
+		h.setupAvatarHandlers(rg)
+		h.setupAccountDeletionHandlers(rg)
+		h.setupExportHandlers(rg)
+		h.setupConsentHandlers(rg)
+		h.setupSessionHandlers(rg)
+		h.setupLoginHistoryHandlers(rg)
+		h.setupAuditHandlers(rg)
+		h.setupWebhookHandlers(rg)
+	}
+	h.setupRealmHandlers()
 	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
 	return h
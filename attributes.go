@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+//attributeSchema describes a user custom attribute allowed in a realm
+type attributeSchema struct {
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Pattern  string `json:"pattern"`
+	Claim    string `json:"claim"`
+	regex    *regexp.Regexp
+}
+
+var attributeTypes = []string{"string", "number", "boolean"}
+
+//claims created by userme that can't be overwritten by custom attributes
+var reservedClaims = []string{"iss", "sub", "aud", "exp", "iat", "nbf", "jti", "typ", "authType", "email", "scope", "roles", "org_id", "org_role", "socialToken", "consents", "sid"}
+
+//parseAttributesSchema parses a realm attributes schema in the format {"attrName": {"type": "string", "required": true, "pattern": "^.+$", "claim": "claimName"}}
+func parseAttributesSchema(schemaJSON string) (map[string]attributeSchema, error) {
+	schema := make(map[string]attributeSchema)
+	if schemaJSON == "" {
+		return schema, nil
+	}
+	err := json.Unmarshal([]byte(schemaJSON), &schema)
+	if err != nil {
+		return nil, err
+	}
+	for name, as := range schema {
+		if !isOneOf(as.Type, attributeTypes) {
+			return nil, fmt.Errorf("Attribute %s has invalid type '%s'", name, as.Type)
+		}
+		if as.Pattern != "" {
+			if as.Type != "string" {
+				return nil, fmt.Errorf("Attribute %s has a pattern but is not a string", name)
+			}
+			as.regex, err = regexp.Compile(as.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Attribute %s has invalid pattern. err=%s", name, err)
+			}
+		}
+		if isOneOf(as.Claim, reservedClaims) {
+			return nil, fmt.Errorf("Attribute %s can't be mapped to reserved claim %s", name, as.Claim)
+		}
+		schema[name] = as
+	}
+	return schema, nil
+}
+
+//validateAttributes returns the violations of the attributes against the realm schema
+func validateAttributes(schema map[string]attributeSchema, attributes map[string]interface{}) []string {
+	violations := make([]string, 0)
+	for name, v := range attributes {
+		as, exists := schema[name]
+		if !exists {
+			violations = append(violations, fmt.Sprintf("%s: unknown attribute", name))
+			continue
+		}
+		valid := false
+		switch as.Type {
+		case "string":
+			s, ok := v.(string)
+			valid = ok && (as.regex == nil || as.regex.MatchString(s))
+		case "number":
+			_, valid = v.(float64)
+		case "boolean":
+			_, valid = v.(bool)
+		}
+		if !valid {
+			violations = append(violations, fmt.Sprintf("%s: invalid %s", name, as.Type))
+		}
+	}
+	for name, as := range schema {
+		_, exists := attributes[name]
+		if as.Required && !exists {
+			violations = append(violations, fmt.Sprintf("%s: required", name))
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+//attributeClaims returns the custom attributes mapped to token claims by the realm schema
+func attributeClaims(schema map[string]attributeSchema, attributesJSON string) map[string]interface{} {
+	claims := make(map[string]interface{})
+	if attributesJSON == "" {
+		return claims
+	}
+	attributes := make(map[string]interface{})
+	err := json.Unmarshal([]byte(attributesJSON), &attributes)
+	if err != nil {
+		return claims
+	}
+	for name, as := range schema {
+		v, exists := attributes[name]
+		if exists && as.Claim != "" {
+			claims[as.Claim] = v
+		}
+	}
+	return claims
+}
+
+func isOneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//blobStorage stores binary objects (such as user avatars) by key
+type blobStorage interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) (data []byte, contentType string, err error)
+	Delete(key string) error
+}
+
+var errBlobNotFound = fmt.Errorf("Blob not found")
+
+var blobs blobStorage
+
+//newBlobStorage creates the storage selected by --blob-storage
+func newBlobStorage() (blobStorage, error) {
+	switch opt.blobStorage {
+	case "local":
+		return &localBlobStorage{dir: opt.blobStorageDir}, nil
+	case "s3":
+		if opt.s3Endpoint == "" || opt.s3Bucket == "" || opt.s3AccessKey == "" || opt.s3SecretKey == "" {
+			return nil, fmt.Errorf("--s3-endpoint, --s3-bucket, --s3-access-key and --s3-secret-key are required for s3 blob storage")
+		}
+		return &s3BlobStorage{
+			endpoint:  strings.TrimSuffix(opt.s3Endpoint, "/"),
+			region:    opt.s3Region,
+			bucket:    opt.s3Bucket,
+			accessKey: opt.s3AccessKey,
+			secretKey: opt.s3SecretKey,
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	}
+	return nil, fmt.Errorf("Invalid blob storage '%s'. Use 'local' or 's3'", opt.blobStorage)
+}
+
+//localBlobStorage stores blobs as files in a local directory. Content type is kept in a sibling '.type' file
+type localBlobStorage struct {
+	dir string
+}
+
+func (s *localBlobStorage) path(key string) (string, error) {
+	p := filepath.Join(s.dir, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, filepath.Clean(s.dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Invalid blob key %s", key)
+	}
+	return p, nil
+}
+
+func (s *localBlobStorage) Put(key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(p+".type", []byte(contentType), 0644)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func (s *localBlobStorage) Get(key string) ([]byte, string, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, "", errBlobNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	contentType, err := ioutil.ReadFile(p + ".type")
+	if err != nil {
+		contentType = []byte(http.DetectContentType(data))
+	}
+	return data, string(contentType), nil
+}
+
+func (s *localBlobStorage) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	os.Remove(p + ".type")
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//s3BlobStorage stores blobs in a S3 compatible service (AWS S3, MinIO...) using path style urls and AWS Signature Version 4
+type s3BlobStorage struct {
+	endpoint  string
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3BlobStorage) Put(key string, data []byte, contentType string) error {
+	resp, err := s.request("PUT", key, data, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("S3 PUT %s status=%d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3BlobStorage) Get(key string) ([]byte, string, error) {
+	resp, err := s.request("GET", key, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 404 {
+		return nil, "", errBlobNotFound
+	}
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("S3 GET %s status=%d", key, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (s *s3BlobStorage) Delete(key string) error {
+	resp, err := s.request("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 && resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return fmt.Errorf("S3 DELETE %s status=%d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *s3BlobStorage) request(method string, key string, body []byte, headers map[string]string) (*http.Response, error) {
+	path := "/" + s3URIEncode(s.bucket, false) + "/" + s3URIEncode(key, true)
+	req, err := http.NewRequest(method, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signS3Request(req, path, body, s.region, s.accessKey, s.secretKey, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+//signS3Request adds an AWS Signature Version 4 'Authorization' header to the request. See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signS3Request(req *http.Request, canonicalURI string, body []byte, region string, accessKey string, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0)
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders = canonicalHeaders + k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, canonicalURI, req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+//s3URIEncode encodes as required by AWS signatures (RFC 3986 unreserved characters are kept)
+func s3URIEncode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/md4"
+)
+
+//breachIndexMagic starts the compact index built from a Pwned Passwords dataset. The index has a header (magic, hash length),
+//a table with the position of the first record of each 2 byte hash prefix and the records ordered by hash, each with the rest of the hash and the breach count (uint32)
+var breachIndexMagic = []byte("UMBREACH")
+
+const breachIndexHeaderSize = 16
+const breachIndexBuckets = 65536
+
+//breachIndex looks up password hashes in the index file without loading the records into memory
+type breachIndex struct {
+	file       *os.File
+	hashLen    int
+	buckets    []uint64
+	recordSize int64
+}
+
+var breachedPasswords *breachIndex
+
+//openBreachedPasswordsDataset opens the index of --breached-password-dataset. Datasets in the 'HASH:COUNT' text format of haveibeenpwned.com (SHA-1 or NTLM, ordered by hash)
+//are converted to an index in '<dataset>.idx' on the first use and whenever the dataset changes
+func openBreachedPasswordsDataset(dataset string) (*breachIndex, error) {
+	isIndex, err := isBreachIndex(dataset)
+	if err != nil {
+		return nil, err
+	}
+	indexFile := dataset
+	if !isIndex {
+		indexFile = dataset + ".idx"
+		ds, err := os.Stat(dataset)
+		if err != nil {
+			return nil, err
+		}
+		is, err := os.Stat(indexFile)
+		if err != nil || is.ModTime().Before(ds.ModTime()) {
+			logrus.Infof("Building breached passwords index %s. This may take a while for large datasets", indexFile)
+			start := time.Now()
+			count, err := buildBreachIndex(dataset, indexFile)
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("Breached passwords index built with %d hashes in %s", count, time.Since(start))
+		}
+	}
+
+	f, err := os.Open(indexFile)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, breachIndexHeaderSize+8*(breachIndexBuckets+1))
+	_, err = io.ReadFull(f, header)
+	if err != nil || !bytes.Equal(header[:len(breachIndexMagic)], breachIndexMagic) {
+		f.Close()
+		return nil, fmt.Errorf("Invalid breached passwords index %s", indexFile)
+	}
+	bi := breachIndex{file: f, hashLen: int(header[len(breachIndexMagic)])}
+	if bi.hashLen != sha1.Size && bi.hashLen != md4.Size {
+		f.Close()
+		return nil, fmt.Errorf("Unsupported hash length %d in breached passwords index %s", bi.hashLen, indexFile)
+	}
+	bi.recordSize = int64(bi.hashLen - 2 + 4)
+	bi.buckets = make([]uint64, breachIndexBuckets+1)
+	for i := range bi.buckets {
+		bi.buckets[i] = binary.LittleEndian.Uint64(header[breachIndexHeaderSize+8*i:])
+	}
+	logrus.Infof("Breached passwords index %s loaded with %d %s hashes", indexFile, bi.buckets[breachIndexBuckets], bi.hashType())
+	return &bi, nil
+}
+
+func isBreachIndex(file string) (bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(breachIndexMagic))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && bytes.Equal(magic, breachIndexMagic), nil
+}
+
+//buildBreachIndex converts a text dataset to an index. The hash algorithm is detected by the hash length
+func buildBreachIndex(dataset string, indexFile string) (int64, error) {
+	in, err := os.Open(dataset)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	tmpFile := indexFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile)
+	defer out.Close()
+
+	tableSize := int64(8 * (breachIndexBuckets + 1))
+	_, err = out.Seek(breachIndexHeaderSize+tableSize, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriterSize(out, 1024*1024)
+	counts := make([]uint64, breachIndexBuckets)
+	hashLen := 0
+	var last []byte
+	var total int64
+	scanner := bufio.NewScanner(in)
+	record := make([]byte, 0, 64)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		hash, err := hex.DecodeString(parts[0])
+		if err != nil || (len(hash) != sha1.Size && len(hash) != md4.Size) || (hashLen != 0 && len(hash) != hashLen) {
+			return 0, fmt.Errorf("Invalid hash in line %d of %s. Use the SHA-1 or NTLM 'HASH:COUNT' format", lineNumber, dataset)
+		}
+		hashLen = len(hash)
+		if last != nil && bytes.Compare(hash, last) <= 0 {
+			return 0, fmt.Errorf("Hashes in %s must be ordered and unique. See line %d", dataset, lineNumber)
+		}
+		last = hash
+		count := uint64(1)
+		if len(parts) == 2 {
+			count, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid count in line %d of %s", lineNumber, dataset)
+			}
+		}
+		if count > 0xffffffff {
+			count = 0xffffffff
+		}
+		record = append(record[:0], hash[2:]...)
+		record = append(record, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(record[len(record)-4:], uint32(count))
+		_, err = w.Write(record)
+		if err != nil {
+			return 0, err
+		}
+		counts[int(hash[0])<<8|int(hash[1])]++
+		total++
+	}
+	if scanner.Err() != nil {
+		return 0, scanner.Err()
+	}
+	if hashLen == 0 {
+		return 0, fmt.Errorf("Breached passwords dataset %s is empty", dataset)
+	}
+	err = w.Flush()
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, breachIndexHeaderSize+tableSize)
+	copy(header, breachIndexMagic)
+	header[len(breachIndexMagic)] = byte(hashLen)
+	position := uint64(0)
+	for i := 0; i <= breachIndexBuckets; i++ {
+		binary.LittleEndian.PutUint64(header[breachIndexHeaderSize+8*i:], position)
+		if i < breachIndexBuckets {
+			position += counts[i]
+		}
+	}
+	_, err = out.WriteAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = out.Close()
+	if err != nil {
+		return 0, err
+	}
+	return total, os.Rename(tmpFile, indexFile)
+}
+
+func (bi *breachIndex) hashType() string {
+	if bi.hashLen == md4.Size {
+		return "ntlm"
+	}
+	return "sha1"
+}
+
+//count returns how many times the password appeared in breaches according to the index
+func (bi *breachIndex) count(password string) (int, error) {
+	hash := passwordDatasetHash(password, bi.hashType())
+	bucket := int(hash[0])<<8 | int(hash[1])
+	first := int64(bi.buckets[bucket])
+	size := int(bi.buckets[bucket+1] - bi.buckets[bucket])
+	suffix := hash[2:]
+	offset := int64(breachIndexHeaderSize + 8*(breachIndexBuckets+1))
+
+	var readErr error
+	record := make([]byte, bi.recordSize)
+	readRecord := func(i int) []byte {
+		_, err := bi.file.ReadAt(record, offset+(first+int64(i))*bi.recordSize)
+		if err != nil {
+			readErr = err
+		}
+		return record
+	}
+	i := sort.Search(size, func(i int) bool {
+		return readErr != nil || bytes.Compare(readRecord(i)[:len(suffix)], suffix) >= 0
+	})
+	if readErr != nil {
+		return 0, readErr
+	}
+	if i == size || !bytes.Equal(readRecord(i)[:len(suffix)], suffix) {
+		return 0, readErr
+	}
+	return int(binary.LittleEndian.Uint32(record[len(suffix):])), readErr
+}
+
+//passwordDatasetHash hashes a password as in Pwned Passwords datasets. NTLM is the MD4 of the UTF-16LE password
+func passwordDatasetHash(password string, hashType string) []byte {
+	if hashType == "ntlm" {
+		h := md4.New()
+		for _, c := range utf16.Encode([]rune(password)) {
+			h.Write([]byte{byte(c), byte(c >> 8)})
+		}
+		return h.Sum(nil)
+	}
+	h := sha1.Sum([]byte(password))
+	return h[:]
+}
+
+//pwnedPasswordsAPICount queries a Pwned Passwords compatible range API (https://haveibeenpwned.com/API/v3#PwnedPasswords) with k-anonymity:
+//only the first 5 hex characters of the password SHA-1 are sent and the other hashes in the same range are compared locally
+func pwnedPasswordsAPICount(password string) (int, error) {
+	hash := strings.ToUpper(hex.EncodeToString(passwordDatasetHash(password, "sha1")))
+	req, err := http.NewRequest("GET", strings.TrimSuffix(opt.breachedPasswordAPIURL, "/")+"/"+hash[:5], nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Add-Padding", "true")
+	req.Header.Set("User-Agent", "userme")
+	client := http.Client{Timeout: time.Duration(opt.breachedPasswordAPITimeout) * time.Millisecond}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, fmt.Errorf("Pwned Passwords API returned status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], hash[5:]) {
+			//padding entries have count 0
+			return strconv.Atoi(parts[1])
+		}
+	}
+	return 0, nil
+}
+
+//breachedPasswordCheckEnabled returns true if a breached passwords dataset or API is configured
+func breachedPasswordCheckEnabled() bool {
+	return breachedPasswords != nil || opt.breachedPasswordAPIURL != ""
+}
+
+//passwordBreached returns true if the password was found in the local dataset or, if not, in the Pwned Passwords API.
+//Lookup failures are logged and the password is considered not breached, so an unavailable API doesn't block signups and password changes
+func passwordBreached(password string) bool {
+	if breachedPasswords != nil {
+		count, err := breachedPasswords.count(password)
+		if err != nil {
+			logrus.Warnf("Couldn't search breached passwords index. err=%s", err)
+		}
+		if count > 0 {
+			breachedPasswordCounter.WithLabelValues("dataset", "breached").Inc()
+			return true
+		}
+		breachedPasswordCounter.WithLabelValues("dataset", "clean").Inc()
+	}
+	if opt.breachedPasswordAPIURL != "" {
+		count, err := pwnedPasswordsAPICount(password)
+		if err != nil {
+			logrus.Warnf("Couldn't query breached passwords API. err=%s", err)
+			breachedPasswordCounter.WithLabelValues("api", "error").Inc()
+			return false
+		}
+		if count > 0 {
+			breachedPasswordCounter.WithLabelValues("api", "breached").Inc()
+			return true
+		}
+		breachedPasswordCounter.WithLabelValues("api", "clean").Inc()
+	}
+	return false
+}
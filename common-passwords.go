@@ -0,0 +1,44 @@
+package main
+
+//commonPasswordList is a bundled list of the most used passwords, found in public leak compilations. Extend it with --password-dictionary-file
+const commonPasswordList = `
+123456 password 12345678 qwerty 123456789 12345 1234 111111 1234567 dragon 123123 baseball abc123
+football monkey letmein 696969 shadow master 666666 qwertyuiop 123321 mustang 1234567890 michael
+654321 superman 1qaz2wsx 7777777 121212 000000 qazwsx 123qwe killer trustno1 jordan jennifer
+zxcvbnm asdfgh hunter buster soccer harley batman andrew tigger sunshine iloveyou 2000 charlie
+robert thomas hockey ranger daniel starwars klaster 112233 george computer michelle jessica pepper
+1111 zxcvbn 555555 11111111 131313 freedom 777777 pass maggie 159753 aaaaaa ginger princess joshua
+cheese amanda summer love ashley nicole chelsea biteme matthew access yankees 987654321 dallas
+austin thunder taylor matrix mobilemail mom monitor monitoring montana moon moscow welcome passw0rd
+password1 password123 qwerty123 1q2w3e4r 1q2w3e4r5t 1q2w3e qwe123 zaq12wsx admin administrator root
+toor guest default changeme secret login abc12345 abcd1234 aa123456 a123456 123abc 123456a 12345a
+q1w2e3r4 q1w2e3r4t5 iloveyou1 princess1 sunshine1 football1 monkey1 charlie1 shadow1 master1
+welcome1 letmein1 dragon1 baseball1 superman1 qwertyui asdfghjkl zxcvbnm1 asdf1234 asdfasdf
+qwerqwer 1qazxsw2 zxcv1234 qweasd qweasdzxc 147258369 159357 147258 789456 456789 987654 246810
+135790 102030 112211 123654 123789 111222 121314 202020 101010 888888 999999 123123123 11223344
+1212 00000000 88888888 99999999 66666666 12341234 12344321 1234qwer qwer1234 password12 password2
+password! p@ssw0rd p@ssword pa55word pass123 pass1234 passpass letmein123 welcome123 admin123
+admin1 root123 test test123 test1234 testing testtest demo demo123 user user123 guest123 qwerty1
+qwerty12 iloveu ilovey0u lovely loveme lover loving hello hello123 hellohello hi whatever nothing
+blahblah asdf qwert zxcvb abcdef abcdefg abcdefgh abc abcabc jesus jesus1 god christ heaven angel
+angels angel1 faith blessed grace hope peace money money1 cash rich lucky lucky7 winner winner1
+success cookie chocolate banana orange apple cherry pumpkin butter honey sugar candy peanut pizza
+coffee tequila whiskey vodka beer flower rose lily daisy summer1 winter spring autumn snow rain
+sunny sunday monday friday london paris berlin tokyo madrid rome chicago boston texas florida
+california canada america brazil mexico soccer1 hockey1 tennis golf golfer basketball baseball2
+yankee redsox cowboys steelers lakers eagles packers raiders batman1 spiderman ironman hulk pokemon
+pikachu naruto goku mario zelda minecraft fortnite roblox warcraft starwars1 jedi yoda harrypotter
+hogwarts gandalf frodo matrix1 neo trinity morpheus michael1 jennifer1 jessica1 ashley1 daniel1
+andrew1 joshua1 matthew1 robert1 thomas1 william william1 james james1 david david1 john john1
+anthony justin justin1 brandon brandon1 jordan1 jordan23 michelle1 nicole1 amanda1 melissa melissa1
+sarah sarah1 hannah hannah1 samantha purple yellow green blue black white red silver golden diamond
+crystal tiger lion eagle falcon wolf bear shark dolphin horse horses kitten kitty puppy doggy dog
+cat fish bird mercedes ferrari porsche corvette camaro mustang1 honda toyota nissan bmw audi
+internet computer1 google facebook twitter youtube myspace linkedin yahoo hotmail gmail samsung
+iphone apple123 android qazxsw wsxedc edcrfv 1qaz 2wsx 3edc zaq1 xsw2 !qaz2wsx 1qaz@wsx !@#$%^
+!@#$%^&* 1q2w3e4r5t6y asdfg asdfghjk zxcvbnm123 poiuytrewq mnbvcxz lkjhgfdsa secret1 secret123
+private topsecret password11 password01 passwort motdepasse contrasena senha starwars123 superstar
+rockstar rocknroll metallica nirvana slipknot killer1 hunter2 hunter1 shadow12 dragon12 master12
+monkey12 jordan12 1q2w3e4 12qwaszx 123qweasd 123qweasdzxc qwe123qwe 1234abcd abcd123 abc1234 1a2b3c
+1a2b3c4d a1b2c3 a1b2c3d4 letmeinnow iamthebest trustme ihateyou fuckyou fuckoff asshole bitch
+`
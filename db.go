@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mssql"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -14,18 +16,265 @@ import (
 
 //User as in database
 type User struct {
-	Name               string    `gorm:"size:60; not null"`
-	Email              string    `gorm:"primary_key"`
-	PasswordHash       string    `gorm:"size:100; not null"`
-	PasswordDate       time.Time `gorm:"not null"`
-	ActivationDate     *time.Time
-	WrongPasswordCount uint8 `gorm:"not null; default:0"`
-	WrongPasswordDate  *time.Time
-	PasswordValidUntil *time.Time
-	CreationDate       time.Time `gorm:"not null; default:CURRENT_TIMESTAMP"`
-	LastTokenType      *string
-	LastTokenDate      *time.Time
-	Enabled            uint8 `gorm:"not null; default:1"`
+	ID                  string    `gorm:"primary_key; size:36"`
+	Realm               string    `gorm:"size:60; not null; default:'default'; unique_index:idx_users_realm_email"`
+	Name                string    `gorm:"size:60; not null"`
+	Email               string    `gorm:"not null; unique_index:idx_users_realm_email"`
+	PasswordHash        string    `gorm:"size:255; not null"`
+	PasswordDate        time.Time `gorm:"not null"`
+	ActivationDate      *time.Time
+	ApprovalStatus      string `gorm:"size:10"`
+	MailVerifiedDate    *time.Time
+	ActivationMailDate  *time.Time
+	ActivationCodeHash  string `gorm:"size:64"`
+	ActivationCodeTries uint8  `gorm:"not null; default:0"`
+	WrongPasswordCount  uint8  `gorm:"not null; default:0"`
+	WrongPasswordDate   *time.Time
+	PasswordValidUntil  *time.Time
+	CreationDate        time.Time `gorm:"not null; default:CURRENT_TIMESTAMP"`
+	LastTokenType       *string
+	LastTokenDate       *time.Time
+	Enabled             uint8  `gorm:"not null; default:1"`
+	Roles               string `gorm:"size:255"`
+	Locale              string `gorm:"size:20"`
+	Timezone            string `gorm:"size:60"`
+	Phone               string `gorm:"size:30"`
+	CustomAttributes    string `gorm:"type:text"`
+	AvatarKey           string `gorm:"size:150"`
+	DeletionRequestDate *time.Time
+	DeletionDate        *time.Time `gorm:"index"`
+	ErasureDate         *time.Time
+
+	//PasswordResetRequired blocks password logins until the password is reset, as when it was found in a data breach
+	PasswordResetRequired      bool `gorm:"not null; default:false"`
+	PasswordExpirationMailDate *time.Time
+}
+
+//Organization as in database. Usually a customer company with many users
+type Organization struct {
+	ID           string    `gorm:"primary_key; size:36" json:"id"`
+	Realm        string    `gorm:"size:60; not null; default:'default'; index" json:"realm"`
+	Name         string    `gorm:"size:100; not null" json:"name"`
+	CreationDate time.Time `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+}
+
+//Membership of a user in an organization
+type Membership struct {
+	OrganizationID string    `gorm:"primary_key; size:36" json:"organizationId"`
+	UserID         string    `gorm:"primary_key; size:36; index" json:"userId"`
+	Role           string    `gorm:"size:20; not null" json:"role"`
+	Scopes         string    `gorm:"size:255" json:"scopes"`
+	CreationDate   time.Time `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+}
+
+//Invitation sent by e-mail for signing up and/or joining an organization
+type Invitation struct {
+	ID             string     `gorm:"primary_key; size:36" json:"id"`
+	Realm          string     `gorm:"size:60; not null; default:'default'" json:"realm"`
+	Email          string     `gorm:"not null; index" json:"email"`
+	OrganizationID string     `gorm:"size:36; not null" json:"organizationId"`
+	Role           string     `gorm:"size:20; not null" json:"role"`
+	Scopes         string     `gorm:"size:255" json:"scopes"`
+	Roles          string     `gorm:"size:255" json:"roles"`
+	InvitedBy      string     `gorm:"not null" json:"invitedBy"`
+	CreationDate   time.Time  `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+	ExpirationDate time.Time  `gorm:"not null" json:"expirationDate"`
+	AcceptedDate   *time.Time `json:"acceptedDate"`
+}
+
+//ConsentDocument is a version of a document users must agree with, such as terms of service or privacy policy
+type ConsentDocument struct {
+	ID           string    `gorm:"primary_key; size:36" json:"id"`
+	Realm        string    `gorm:"size:60; not null; default:'default'; unique_index:idx_consent_documents_realm_name_version" json:"realm"`
+	Name         string    `gorm:"size:40; not null; unique_index:idx_consent_documents_realm_name_version" json:"name"`
+	Version      int       `gorm:"not null; unique_index:idx_consent_documents_realm_name_version" json:"version"`
+	URL          string    `gorm:"size:255; not null" json:"url"`
+	Mandatory    bool      `gorm:"not null" json:"mandatory"`
+	PublishDate  time.Time `gorm:"not null" json:"publishDate"`
+	CreationDate time.Time `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+}
+
+//Consent is the acceptance of a consent document version by a user
+type Consent struct {
+	ID           string    `gorm:"primary_key; size:36" json:"id"`
+	Realm        string    `gorm:"size:60; not null; default:'default'" json:"realm"`
+	UserID       string    `gorm:"size:36; not null; index" json:"userId"`
+	DocumentName string    `gorm:"size:40; not null" json:"documentName"`
+	Version      int       `gorm:"not null" json:"version"`
+	AcceptDate   time.Time `gorm:"not null" json:"acceptDate"`
+	ClientIP     string    `gorm:"size:45" json:"clientIp"`
+}
+
+//Session is a signin of a user in a device. Its refresh tokens are rejected after it's revoked
+type Session struct {
+	ID             string     `gorm:"primary_key; size:36" json:"id"`
+	Realm          string     `gorm:"size:60; not null; default:'default'" json:"realm"`
+	UserID         string     `gorm:"size:36; not null; index" json:"userId"`
+	DeviceName     string     `gorm:"size:100" json:"deviceName"`
+	UserAgent      string     `gorm:"size:255" json:"userAgent"`
+	ClientIP       string     `gorm:"size:45" json:"clientIp"`
+	AuthType       string     `gorm:"size:20; not null" json:"authType"`
+	CreationDate   time.Time  `gorm:"not null" json:"creationDate"`
+	LastSeenDate   time.Time  `gorm:"not null" json:"lastSeenDate"`
+	RevocationDate *time.Time `json:"revocationDate"`
+}
+
+//LoginAttempt is an append-only record of a signin attempt, successful or not
+type LoginAttempt struct {
+	ID         string    `gorm:"primary_key; size:36" json:"id"`
+	Realm      string    `gorm:"size:60; not null; default:'default'" json:"realm"`
+	UserID     string    `gorm:"size:36; index" json:"userId"`
+	Email      string    `json:"email"`
+	AuthType   string    `gorm:"size:20; not null" json:"authType"`
+	Success    bool      `gorm:"not null" json:"success"`
+	Reason     string    `gorm:"size:40" json:"reason"`
+	ClientIP   string    `gorm:"size:45; index" json:"clientIp"`
+	Network    string    `gorm:"size:50; index" json:"network"`
+	UserAgent  string    `gorm:"size:255" json:"userAgent"`
+	DeviceName string    `gorm:"size:100" json:"deviceName"`
+	Date       time.Time `gorm:"not null; index" json:"date"`
+}
+
+//AuditEvent is a security relevant event kept for compliance. Audit events are not removed when accounts are erased
+type AuditEvent struct {
+	ID       string    `gorm:"primary_key; size:36" json:"id"`
+	Realm    string    `gorm:"size:60; not null; default:'default'; index:idx_audit_events_realm_date" json:"realm"`
+	Type     string    `gorm:"size:40; not null; index" json:"type"`
+	Actor    string    `gorm:"index" json:"actor"`
+	Target   string    `gorm:"index" json:"target"`
+	ClientIP string    `gorm:"size:45" json:"clientIp"`
+	Outcome  string    `gorm:"size:10; not null" json:"outcome"`
+	Details  string    `gorm:"type:text" json:"-"`
+	Date     time.Time `gorm:"not null; index:idx_audit_events_realm_date" json:"date"`
+}
+
+//Webhook is an admin registered endpoint that receives user lifecycle events signed with its secret
+type Webhook struct {
+	ID           string    `gorm:"primary_key; size:36" json:"id"`
+	Realm        string    `gorm:"size:60; not null; default:'default'; index" json:"realm"`
+	URL          string    `gorm:"size:255; not null" json:"url"`
+	Secret       string    `gorm:"size:100; not null" json:"-"`
+	Events       string    `gorm:"size:255; not null" json:"events"`
+	CreationDate time.Time `gorm:"not null" json:"creationDate"`
+}
+
+//WebhookDelivery is an event queued for delivery to a webhook. Deliveries that exhaust their attempts are kept with status 'dead'
+type WebhookDelivery struct {
+	ID              string     `gorm:"primary_key; size:36" json:"id"`
+	Realm           string     `gorm:"size:60; not null; default:'default'" json:"realm"`
+	WebhookID       string     `gorm:"size:36; not null; index" json:"webhookId"`
+	EventID         string     `gorm:"size:36; not null" json:"eventId"`
+	EventType       string     `gorm:"size:40; not null" json:"eventType"`
+	Payload         string     `gorm:"type:text" json:"payload"`
+	Status          string     `gorm:"size:10; not null; index:idx_webhook_deliveries_status_next" json:"status"`
+	Attempts        int        `gorm:"not null" json:"attempts"`
+	NextAttemptDate time.Time  `gorm:"not null; index:idx_webhook_deliveries_status_next" json:"nextAttemptDate"`
+	LastAttemptDate *time.Time `json:"lastAttemptDate"`
+	LastStatusCode  int        `json:"lastStatusCode"`
+	LastError       string     `gorm:"size:255" json:"lastError"`
+	CreationDate    time.Time  `gorm:"not null" json:"creationDate"`
+}
+
+//OutboxEvent is a domain event waiting to be published to the event broker. Saved in the same transaction as the change it describes
+type OutboxEvent struct {
+	ID           string     `gorm:"primary_key; size:36" json:"id"`
+	Realm        string     `gorm:"size:60; not null; default:'default'" json:"realm"`
+	Type         string     `gorm:"size:40; not null" json:"type"`
+	Payload      string     `gorm:"type:text" json:"payload"`
+	Attempts     int        `gorm:"not null" json:"attempts"`
+	LastError    string     `gorm:"size:255" json:"lastError"`
+	CreationDate time.Time  `gorm:"not null; index" json:"creationDate"`
+	PublishDate  *time.Time `gorm:"index" json:"publishDate"`
+}
+
+//PasswordHistory keeps the last password hashes of a user so that they can't be reused
+type PasswordHistory struct {
+	ID           string    `gorm:"primary_key; size:36" json:"id"`
+	Realm        string    `gorm:"size:60; not null; default:'default'" json:"realm"`
+	UserID       string    `gorm:"size:36; not null; index" json:"userId"`
+	PasswordHash string    `gorm:"size:255; not null" json:"-"`
+	CreationDate time.Time `gorm:"not null" json:"creationDate"`
+}
+
+//IPBan is a temporary ban of an address (ip or subnet) with too many failed logins across accounts
+type IPBan struct {
+	ID             string    `gorm:"primary_key; size:36" json:"id"`
+	Realm          string    `gorm:"size:60; not null; default:'default'; index" json:"realm"`
+	Scope          string    `gorm:"size:10; not null" json:"scope"`
+	Address        string    `gorm:"size:50; not null; index" json:"address"`
+	Failures       int       `json:"failures"`
+	CreationDate   time.Time `gorm:"not null" json:"creationDate"`
+	ExpirationDate time.Time `gorm:"not null; index" json:"expirationDate"`
+}
+
+//Realm is a fully isolated tenant with its own users, keys, mail settings and policies
+type Realm struct {
+	Name                    string    `gorm:"primary_key; size:60" json:"name"`
+	Hosts                   string    `gorm:"size:255" json:"hosts"`
+	JWTIssuer               string    `gorm:"size:100; not null" json:"jwtIssuer"`
+	JWTSigningMethod        string    `gorm:"size:10; not null" json:"jwtSigningMethod"`
+	JWTSigningKey           string    `gorm:"type:text" json:"-"`
+	PasswordValidationRegex string    `gorm:"size:255; not null" json:"passwordValidationRegex"`
+	AccountActivationMethod string    `gorm:"size:20; not null" json:"accountActivationMethod"`
+	SignupMethod            string    `gorm:"size:20; not null; default:'open'" json:"signupMethod"`
+	ActivationTokenFormat   string    `gorm:"size:10; not null; default:'jwt'" json:"activationTokenFormat"`
+	TokenSubject            string    `gorm:"size:10; not null; default:'id'" json:"tokenSubject"`
+	AttributesSchema        string    `gorm:"type:text" json:"attributesSchema"`
+	PasswordPolicy          string    `gorm:"type:text" json:"passwordPolicy"`
+	MailSMTPHost            string    `gorm:"size:255" json:"mailSMTPHost"`
+	MailSMTPPort            int       `json:"mailSMTPPort"`
+	MailSMTPUser            string    `gorm:"size:255" json:"mailSMTPUser"`
+	MailSMTPPass            string    `gorm:"size:255" json:"-"`
+	MailFromAddress         string    `gorm:"size:255" json:"mailFromAddress"`
+	MailFromName            string    `gorm:"size:100" json:"mailFromName"`
+	GoogleClientID          string    `gorm:"size:255" json:"googleClientId"`
+	GoogleClientSecret      string    `gorm:"size:255" json:"-"`
+	FacebookClientID        string    `gorm:"size:255" json:"facebookClientId"`
+	FacebookClientSecret    string    `gorm:"size:255" json:"-"`
+	PreSignupHookURL        string    `gorm:"size:255" json:"preSignupHookUrl"`
+	PreSignupHookTimeout    int       `gorm:"not null; default:3000" json:"preSignupHookTimeout"`
+	PreSignupHookFailPolicy string    `gorm:"size:10; not null; default:'closed'" json:"preSignupHookFailPolicy"`
+	PreTokenHookURL         string    `gorm:"size:255" json:"preTokenHookUrl"`
+	PreTokenHookTimeout     int       `gorm:"not null; default:3000" json:"preTokenHookTimeout"`
+	PreTokenHookFailPolicy  string    `gorm:"size:10; not null; default:'closed'" json:"preTokenHookFailPolicy"`
+	HooksSecret             string    `gorm:"size:100" json:"-"`
+	CreationDate            time.Time `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+}
+
+//EmailChange requested by a user. The old address may undo it for some time after confirmation
+type EmailChange struct {
+	ID               string     `gorm:"primary_key; size:36" json:"id"`
+	Realm            string     `gorm:"size:60; not null; default:'default'" json:"realm"`
+	UserID           string     `gorm:"size:36; not null; index" json:"userId"`
+	OldEmail         string     `gorm:"not null" json:"oldEmail"`
+	NewEmail         string     `gorm:"not null" json:"newEmail"`
+	CreationDate     time.Time  `gorm:"not null; default:CURRENT_TIMESTAMP" json:"creationDate"`
+	ConfirmationDate *time.Time `json:"confirmationDate"`
+	UndoDate         *time.Time `json:"undoDate"`
+}
+
+//MailTemplate used for sending mails to users of a realm
+type MailTemplate struct {
+	Realm   string `gorm:"primary_key; size:60" json:"realm"`
+	Name    string `gorm:"primary_key; size:40" json:"name"`
+	Subject string `gorm:"size:255; not null" json:"subject"`
+	HTML    string `gorm:"type:text; not null" json:"html"`
+}
+
+//Migration applied to the database schema
+type Migration struct {
+	ID          string    `gorm:"primary_key; size:100"`
+	AppliedDate time.Time `gorm:"not null"`
+}
+
+//migrations that can't be handled by AutoMigrate. Executed in this order only once
+var migrations = []struct {
+	id string
+	fn func(tx *gorm.DB) error
+}{
+	{"user-id", backfillUserIDs},
+	{"user-id-primary-key", func(tx *gorm.DB) error { return rebuildTable(tx, &User{}) }},
+	{"user-password-hash-size", func(tx *gorm.DB) error { return widenColumn(tx, &User{}, "PasswordHash") }},
 }
 
 func initDB() (*gorm.DB, error) {
@@ -57,7 +306,139 @@ func initDB() (*gorm.DB, error) {
 	db0.Set("gorm:table_options", "charset=utf8")
 
 	logrus.Infof("Checking database schema")
-	db0.AutoMigrate(&User{})
+	freshDatabase := !db0.HasTable(&User{})
+	db0.AutoMigrate(&User{}, &Organization{}, &Membership{}, &Invitation{}, &EmailChange{}, &ConsentDocument{}, &Consent{}, &Session{}, &LoginAttempt{}, &AuditEvent{}, &Webhook{}, &WebhookDelivery{}, &OutboxEvent{}, &PasswordHistory{}, &IPBan{}, &Realm{}, &MailTemplate{}, &Migration{})
+
+	err = runMigrations(db0, freshDatabase)
+	if err != nil {
+		logrus.Errorf("Couldn't migrate database. err=%s", err)
+		return db0, err
+	}
 
 	return db0, nil
 }
+
+func runMigrations(db0 *gorm.DB, freshDatabase bool) error {
+	for _, m := range migrations {
+		if !db0.First(&Migration{}, "id = ?", m.id).RecordNotFound() {
+			continue
+		}
+		err := db0.Transaction(func(tx *gorm.DB) error {
+			if !freshDatabase {
+				logrus.Infof("Running database migration %s", m.id)
+				err := m.fn(tx)
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Create(&Migration{ID: m.id, AppliedDate: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %s failed. err=%s", m.id, err)
+		}
+	}
+	return nil
+}
+
+//rebuildTable recreates a table with the current model definition and copies all its rows.
+//Used for changes AutoMigrate doesn't handle, such as primary keys
+func rebuildTable(tx *gorm.DB, model interface{}) error {
+	scope := tx.NewScope(model)
+	tableName := scope.TableName()
+	tmpTableName := tableName + "_rebuild"
+
+	columns := make([]string, 0)
+	for _, f := range scope.GetModelStruct().StructFields {
+		if f.IsNormal && !f.IsIgnored {
+			columns = append(columns, scope.Quote(f.DBName))
+		}
+	}
+	cols := strings.Join(columns, ", ")
+
+	//index names are unique per schema in some databases, so the indexes of the original table are dropped first
+	for _, name := range modelIndexNames(scope, tableName) {
+		if scope.Dialect().HasIndex(tableName, name) {
+			err := tx.Table(tableName).RemoveIndex(name).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := tx.Table(tmpTableName).CreateTable(model).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", scope.Quote(tmpTableName), cols, cols, scope.Quote(tableName))).Error
+	if err != nil {
+		return err
+	}
+	err = tx.DropTable(tableName).Error
+	if err != nil {
+		return err
+	}
+	if opt.dbDialect == "mssql" {
+		return tx.Exec(fmt.Sprintf("EXEC sp_rename '%s', '%s'", tmpTableName, tableName)).Error
+	}
+	return tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s", scope.Quote(tmpTableName), scope.Quote(tableName))).Error
+}
+
+//widenColumn changes the type of an existing column to the one of the current model definition.
+//Used for size increases, which AutoMigrate doesn't apply to existing columns
+func widenColumn(tx *gorm.DB, model interface{}, fieldName string) error {
+	//sqlite doesn't enforce varchar sizes
+	if opt.dbDialect == "sqlite3" {
+		return nil
+	}
+	scope := tx.NewScope(model)
+	field, ok := scope.FieldByName(fieldName)
+	if !ok {
+		return fmt.Errorf("field %s not found", fieldName)
+	}
+	typ := scope.Dialect().DataTypeOf(field.StructField)
+	//postgres only accepts the type itself when altering a column. Constraints are kept
+	if opt.dbDialect == "postgres" {
+		typ = strings.Fields(typ)[0]
+	}
+	return tx.Model(model).ModifyColumn(field.DBName, typ).Error
+}
+
+//modelIndexNames returns the names of the indexes gorm creates for a model, as in gorm's autoIndex
+func modelIndexNames(scope *gorm.Scope, tableName string) []string {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, f := range scope.GetModelStruct().StructFields {
+		for tag, kind := range map[string]string{"INDEX": "idx", "UNIQUE_INDEX": "uix"} {
+			value, ok := f.TagSettingsGet(tag)
+			if !ok {
+				continue
+			}
+			for _, name := range strings.Split(value, ",") {
+				if name == "" || name == tag {
+					name = scope.Dialect().BuildKeyName(kind, tableName, f.DBName)
+				}
+				if !seen[name] {
+					seen[name] = true
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+//backfillUserIDs generates the internal ID of users created before it existed
+func backfillUserIDs(tx *gorm.DB) error {
+	users := make([]User, 0)
+	err := tx.Select("realm, email").Find(&users, "id IS NULL OR id = ''").Error
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		err := tx.Model(&User{}).Where("realm = ? AND email = ?", u.Realm, u.Email).UpdateColumn("id", uuid.New().String()).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
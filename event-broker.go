@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+//eventBroker publishes domain events to a message broker. Publish returns only after the broker acknowledged the message
+type eventBroker interface {
+	Publish(subject string, data []byte) error
+	Close() error
+}
+
+var broker eventBroker
+
+//newEventBroker creates the broker selected by --event-broker. Returns nil if event streaming is disabled
+func newEventBroker() (eventBroker, error) {
+	switch opt.eventBroker {
+	case "":
+		return nil, nil
+	case "memory":
+		return &memoryEventBroker{}, nil
+	case "nats":
+		u, err := url.Parse(opt.eventBrokerURL)
+		if err != nil || u.Scheme != "nats" || u.Host == "" {
+			return nil, fmt.Errorf("Invalid --event-broker-url '%s'. Use the format nats://[user:pass@]host:port", opt.eventBrokerURL)
+		}
+		return &natsEventBroker{url: u}, nil
+	}
+	return nil, fmt.Errorf("Invalid event broker '%s'. Use 'nats' or 'memory'", opt.eventBroker)
+}
+
+//memoryEventBroker keeps the last published messages in memory. Useful for development and tests
+type memoryEventBroker struct {
+	sync.Mutex
+	messages []brokerMessage
+}
+
+type brokerMessage struct {
+	Subject string
+	Data    []byte
+}
+
+func (b *memoryEventBroker) Publish(subject string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	b.messages = append(b.messages, brokerMessage{Subject: subject, Data: data})
+	if len(b.messages) > 1000 {
+		b.messages = b.messages[len(b.messages)-1000:]
+	}
+	logrus.Debugf("Event published to memory broker. subject=%s data=%s", subject, string(data))
+	return nil
+}
+
+func (b *memoryEventBroker) Close() error {
+	return nil
+}
+
+//natsEventBroker publishes to NATS (https://docs.nats.io/reference/reference-protocols/nats-protocol) over a single connection, which is reopened after failures. Each PUB is followed by a PING so that a PONG confirms the server processed it
+type natsEventBroker struct {
+	sync.Mutex
+	url    *url.URL
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (b *natsEventBroker) Publish(subject string, data []byte) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.conn == nil {
+		err := b.connect()
+		if err != nil {
+			return err
+		}
+	}
+	err := b.publish(subject, data)
+	if err != nil {
+		b.close()
+	}
+	return err
+}
+
+func (b *natsEventBroker) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.close()
+}
+
+func (b *natsEventBroker) close() error {
+	if b.conn == nil {
+		return nil
+	}
+	err := b.conn.Close()
+	b.conn = nil
+	b.reader = nil
+	return err
+}
+
+func (b *natsEventBroker) connect() error {
+	conn, err := net.DialTimeout("tcp", b.url.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	b.conn = conn
+	b.reader = bufio.NewReader(conn)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := b.reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		b.close()
+		return fmt.Errorf("Invalid NATS server greeting. line=%s err=%v", strings.TrimSpace(line), err)
+	}
+
+	connectOpts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "userme", "lang": "go", "version": "1.0.0"}
+	if b.url.User != nil {
+		pass, hasPass := b.url.User.Password()
+		if hasPass {
+			connectOpts["user"] = b.url.User.Username()
+			connectOpts["pass"] = pass
+		} else {
+			connectOpts["auth_token"] = b.url.User.Username()
+		}
+	}
+	co, _ := json.Marshal(connectOpts)
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", co)
+	if err == nil {
+		err = b.waitPong()
+	}
+	if err != nil {
+		b.close()
+		return err
+	}
+	logrus.Infof("Connected to NATS server %s", b.url.Host)
+	return nil
+}
+
+func (b *natsEventBroker) publish(subject string, data []byte) error {
+	b.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := fmt.Fprintf(b.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(data), data)
+	if err != nil {
+		return err
+	}
+	return b.waitPong()
+}
+
+//waitPong reads server messages until the PONG of our last PING. Server PINGs are answered while waiting
+func (b *natsEventBroker) waitPong() error {
+	for {
+		line, err := b.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			_, err = b.conn.Write([]byte("PONG\r\n"))
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", line)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var hookFailPolicies = []string{"open", "closed"}
+
+//hookResponse is the body hooks respond with. 'allow' defaults to true. 'claims' are only used by pre-token hooks
+type hookResponse struct {
+	Allow   *bool                  `json:"allow"`
+	Message string                 `json:"message"`
+	Claims  map[string]interface{} `json:"claims"`
+}
+
+//processPreSignupHook calls the realm pre-signup hook, if configured. Returns false if the signup must not proceed (the response was already written)
+func processPreSignupHook(r *realmInfo, email string, name string, authType string, c *gin.Context, pmethod string, ppath string) bool {
+	if r.PreSignupHookURL == "" {
+		return true
+	}
+	payload := map[string]interface{}{
+		"email":     email,
+		"name":      name,
+		"authType":  authType,
+		"clientIp":  c.ClientIP(),
+		"userAgent": c.Request.UserAgent(),
+	}
+	_, ok := processHook(r, "pre-signup", r.PreSignupHookURL, r.PreSignupHookTimeout, r.PreSignupHookFailPolicy, email, payload, c, pmethod, ppath)
+	return ok
+}
+
+//processPreTokenHook calls the realm pre-token hook, if configured. Returns the extra access token claims and false if tokens must not be issued (the response was already written)
+func processPreTokenHook(r *realmInfo, u *User, authType string, orgID string, refresh bool, c *gin.Context, pmethod string, ppath string) (map[string]interface{}, bool) {
+	if r.PreTokenHookURL == "" {
+		return nil, true
+	}
+	payload := map[string]interface{}{
+		"user": map[string]interface{}{
+			"id":    u.ID,
+			"email": u.Email,
+			"name":  u.Name,
+			"roles": u.Roles,
+		},
+		"authType":  authType,
+		"orgId":     orgID,
+		"refresh":   refresh,
+		"clientIp":  c.ClientIP(),
+		"userAgent": c.Request.UserAgent(),
+	}
+	return processHook(r, "pre-token", r.PreTokenHookURL, r.PreTokenHookTimeout, r.PreTokenHookFailPolicy, u.Email, payload, c, pmethod, ppath)
+}
+
+func processHook(r *realmInfo, hookType string, url string, timeoutMillis int, failPolicy string, email string, payload map[string]interface{}, c *gin.Context, pmethod string, ppath string) (map[string]interface{}, bool) {
+	start := time.Now()
+	hr, err := callHook(r, hookType, url, timeoutMillis, payload)
+	if err != nil {
+		if failPolicy == "open" {
+			logrus.Warnf("Hook %s failed for %s after %s. Proceeding (fail open). err=%s", hookType, email, time.Since(start), err)
+			return nil, true
+		}
+		logrus.Warnf("Hook %s failed for %s after %s. Denying (fail closed). err=%s", hookType, email, time.Since(start), err)
+		c.JSON(503, gin.H{"message": "Service unavailable"})
+		invocationCounter.WithLabelValues(pmethod, ppath, "503").Inc()
+		return nil, false
+	}
+
+	if hr.Allow != nil && !*hr.Allow {
+		message := hr.Message
+		if message == "" {
+			message = "Denied"
+		}
+		logrus.Infof("Hook %s denied %s. message=%s", hookType, email, message)
+		auditEvent(c, "hook.deny", email, email, false, map[string]interface{}{"hook": hookType, "message": message})
+		c.JSON(485, gin.H{"message": message})
+		invocationCounter.WithLabelValues(pmethod, ppath, "485").Inc()
+		return nil, false
+	}
+
+	claims := make(map[string]interface{})
+	for k, v := range hr.Claims {
+		if isOneOf(k, reservedClaims) {
+			logrus.Warnf("Hook %s returned reserved claim '%s'. Ignoring it", hookType, k)
+			continue
+		}
+		claims[k] = v
+	}
+	return claims, true
+}
+
+//callHook posts the payload to a hook. It is signed like webhooks when the realm has a hooks secret. Timeouts, non 2xx responses and invalid bodies are failures
+func callHook(r *realmInfo, hookType string, url string, timeoutMillis int, payload map[string]interface{}) (*hookResponse, error) {
+	payload["type"] = hookType
+	payload["realm"] = r.Name
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "userme-hook")
+	req.Header.Set("X-Userme-Hook", hookType)
+	if r.HooksSecret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Userme-Timestamp", timestamp)
+		req.Header.Set("X-Userme-Signature", "sha256="+hex.EncodeToString(hmacSHA256([]byte(r.HooksSecret), timestamp+"."+string(body))))
+	}
+
+	client := &http.Client{Timeout: time.Duration(timeoutMillis) * time.Millisecond}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("Hook responded with status %d", resp.StatusCode)
+	}
+
+	var hr hookResponse
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &hr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid hook response. err=%s", err)
+		}
+	}
+	return &hr, nil
+}
@@ -26,30 +26,106 @@ type options struct {
 	refreshTokenDefaultExpirationMinutes int
 	validationTokenExpirationMinutes     int
 	passwordResetTokenExpirationMinutes  int
+	invitationTokenExpirationMinutes     int
+	emailChangeUndoExpirationMinutes     int
 	accessTokenDefaultScope              string
 	jwtIssuer                            string
+	tokenSubject                         string
+	attributesSchema                     string
+	passwordPolicy                       string
+	passwordDictionaryFile               string
+	breachedPasswordDataset              string
+	breachedPasswordAPIURL               string
+	breachedPasswordAPITimeout           int
 	jwtSigningMethod                     string
 	jwtSigningKeyFile                    string
 	jwtPublicKey                         interface{}
 	jwtPrivateKey                        interface{}
 	masterPublicKeyFile                  string
+	masterPublicKey                      interface{}
 	passwordRetriesMax                   int
 	passwordRetriesTimeSeconds           int
+	passwordLockoutMinutes               int
+	unlockTokenExpirationMinutes         int
+	trustedProxies                       string
+	ipFailuresWindowMinutes              int
+	ipFailuresDelayThreshold             int
+	ipFailuresDelaySeconds               int
+	ipFailuresBanThreshold               int
+	subnetFailuresDelayThreshold         int
+	subnetFailuresBanThreshold           int
+	ipBanMinutes                         int
 	passwordExpirationDays               int
+	passwordExpirationWarningDays        int
+	passwordHistorySize                  int
+	passwordMinAgeHours                  int
+	passwordHashAlgorithm                string
+	passwordBcryptCost                   int
+	passwordArgon2Memory                 int
+	passwordArgon2Iterations             int
+	passwordArgon2Parallelism            int
+	passwordScryptCost                   int
+	passwordPepper                       string
 	accountActivationMethod              string
+	signupMethod                         string
+	activationTokenFormat                string
+	activationResendIntervalSeconds      int
 	passwordValidationRegex              string
+	blobStorage                          string
+	blobStorageDir                       string
+	s3Endpoint                           string
+	s3Region                             string
+	s3Bucket                             string
+	s3AccessKey                          string
+	s3SecretKey                          string
+	avatarMaxSizeBytes                   int
+	avatarSizePixels                     int
+	accountDeletionGraceDays             int
+	auditRetentionDays                   int
+	webhookMaxAttempts                   int
+	webhookRetrySeconds                  int
+	preSignupHookURL                     string
+	preSignupHookTimeout                 int
+	preSignupHookFailPolicy              string
+	preTokenHookURL                      string
+	preTokenHookTimeout                  int
+	preTokenHookFailPolicy               string
+	hooksSecret                          string
+	eventBroker                          string
+	eventBrokerURL                       string
+	eventBrokerRetrySeconds              int
+	eventSubjectPrefix                   string
+	accountDeletionMode                  string
 
-	mailSMTPHost              string
-	mailSMTPPort              int
-	mailSMTPUser              string
-	mailSMTPPass              string
-	mailFromAddress           string
-	mailFromName              string
-	mailActivationSubject     string
-	mailActivationHTMLBody    string
-	mailResetPasswordSubject  string
-	mailResetPasswordHTMLBody string
-	mailTokensTests           string
+	mailSMTPHost                        string
+	mailSMTPPort                        int
+	mailSMTPUser                        string
+	mailSMTPPass                        string
+	mailFromAddress                     string
+	mailFromName                        string
+	mailActivationSubject               string
+	mailActivationHTMLBody              string
+	mailResetPasswordSubject            string
+	mailResetPasswordHTMLBody           string
+	mailInvitationSubject               string
+	mailInvitationHTMLBody              string
+	mailApprovalSubject                 string
+	mailApprovalHTMLBody                string
+	mailRejectionSubject                string
+	mailRejectionHTMLBody               string
+	mailEmailChangeSubject              string
+	mailEmailChangeHTMLBody             string
+	mailEmailChangeNotificationSubject  string
+	mailEmailChangeNotificationHTMLBody string
+	mailAccountDeletionSubject          string
+	mailAccountDeletionHTMLBody         string
+	mailNewSigninSubject                string
+	mailNewSigninHTMLBody               string
+	mailPasswordExpirationSubject       string
+	mailPasswordExpirationHTMLBody      string
+	mailAccountLockedSubject            string
+	mailAccountLockedHTMLBody           string
+	mailTokensTests                     string
 
 	googleClientID       string
 	googleClientSecret   string
@@ -78,15 +154,72 @@ func main() {
 	refreshTokenDefaultExpirationMinutes0 := flag.Int("refreshtoken-expiration-minutes", 40320, "Default refresh token expiration age")
 	validationTokenExpirationMinutes0 := flag.Int("validationtoken-expiration-minutes", 20, "Validation token expiration age (sent to email)")
 	passwordResetTokenExpirationMinutes0 := flag.Int("passwordresettoken-expiration-minutes", 20, "Password reset token expiration age (sent to email)")
+	invitationTokenExpirationMinutes0 := flag.Int("invitationtoken-expiration-minutes", 10080, "Invitation token expiration age (sent to email)")
+	emailChangeUndoExpirationMinutes0 := flag.Int("emailchange-undo-expiration-minutes", 10080, "Time the old address has to undo an email change (link sent to the old email)")
 	accessTokenDefaultScope0 := flag.String("accesstoken-default-scope", "basic", "Default claim (scope) added to all access tokens")
 	passwordRetriesMax0 := flag.Int("password-retries-max", 5, "Max number of incorrect password retries")
 	passwordRetriesTimeSeconds0 := flag.Int("password-retries-time", 5, "Max number of incorrect password retries")
+	passwordLockoutMinutes0 := flag.Int("password-lockout-minutes", 0, "Time after which accounts locked by wrong passwords are unlocked automatically. 0 means locked accounts must be unlocked by mail, by an admin or by a password reset")
+	unlockTokenExpirationMinutes0 := flag.Int("unlocktoken-expiration-minutes", 1440, "Unlock token expiration age (sent to email when an account is locked)")
+	trustedProxies0 := flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of load balancers/reverse proxies whose X-Forwarded-For header is honoured for getting the client IP. X-Forwarded-For is ignored when empty")
+	ipFailuresWindowMinutes0 := flag.Int("ip-failures-window-minutes", 15, "Time window in which failed password logins of an ip or subnet (across all accounts) are counted for delays and bans")
+	ipFailuresDelayThreshold0 := flag.Int("ip-failures-delay-threshold", 5, "Failed logins of an ip in the window after which each new login attempt from it is delayed progressively. 0 disables ip delays")
+	ipFailuresDelaySeconds0 := flag.Int("ip-failures-delay-seconds", 1, "Delay after the first failure beyond a delay threshold. It doubles with each new failure, up to the failures window")
+	ipFailuresBanThreshold0 := flag.Int("ip-failures-ban-threshold", 20, "Failed logins of an ip in the window after which the ip is banned from logging in for --ip-ban-minutes. 0 disables ip bans")
+	subnetFailuresDelayThreshold0 := flag.Int("subnet-failures-delay-threshold", 20, "Failed logins of a subnet (/24 for IPv4, /64 for IPv6) in the window after which login attempts from it are delayed progressively. 0 disables subnet delays")
+	subnetFailuresBanThreshold0 := flag.Int("subnet-failures-ban-threshold", 100, "Failed logins of a subnet in the window after which the subnet is banned from logging in for --ip-ban-minutes. 0 disables subnet bans")
+	ipBanMinutes0 := flag.Int("ip-ban-minutes", 30, "Duration of ip and subnet bans")
 	passwordExpirationDays0 := flag.Int("password-expiration-days", -1, "Password expiration time. This will force a password change. -1 means no expiration")
-	accountActivationMethod0 := flag.String("account-activation-method", "direct", "Activation method for new accounts. One of 'direct' (no additional steps needed) or 'mail' (send e-mail with activation link to user)")
+	passwordExpirationWarningDays0 := flag.Int("password-expiration-warning-days", 7, "Days before the password expiration when users are warned by mail (see --mail-password-expiration-subject). 0 disables the warning")
+	passwordHistorySize0 := flag.Int("password-history-size", 0, "Number of previous passwords of each user that can't be reused, including the current one. 0 disables the history")
+	passwordMinAgeHours0 := flag.Int("password-min-age-hours", 0, "Minimum time before users can change their password again, so the history can't be cycled through. Password resets are not affected. 0 means no minimum age")
+	passwordHashAlgorithm0 := flag.String("password-hash-algorithm", "bcrypt", "Algorithm used for hashing new passwords. One of 'bcrypt', 'argon2id' or 'scrypt'. Existing hashes of other algorithms are rehashed on the next successful login")
+	passwordBcryptCost0 := flag.Int("password-bcrypt-cost", 12, "bcrypt cost (4 to 31)")
+	passwordArgon2Memory0 := flag.Int("password-argon2-memory", 65536, "argon2id memory in KiB")
+	passwordArgon2Iterations0 := flag.Int("password-argon2-iterations", 3, "argon2id iterations")
+	passwordArgon2Parallelism0 := flag.Int("password-argon2-parallelism", 2, "argon2id parallelism (threads)")
+	passwordScryptCost0 := flag.Int("password-scrypt-cost", 15, "scrypt cost as the log2 of N (10 to 20)")
+	passwordPepper0 := flag.String("password-pepper", "", "Server side secret combined with passwords before hashing. Never change it after passwords were hashed with it")
+	accountActivationMethod0 := flag.String("account-activation-method", "direct", "Activation method for new accounts. One of 'direct' (no additional steps needed), 'mail' (send e-mail with activation link to user), 'approval' (an admin must approve the account) or 'mail+approval' (both)")
+	signupMethod0 := flag.String("signup-method", "open", "Who can create new accounts. One of 'open' (anyone) or 'invitation' (only holders of a valid invitation)")
+	activationTokenFormat0 := flag.String("activation-token-format", "jwt", "Token sent in activation mails. One of 'jwt' (a JWT token, usually used in links) or 'code' (a 6 digit code that the user types in)")
+	activationResendIntervalSeconds0 := flag.Int("activation-resend-interval-seconds", 60, "Minimum time between activation mails sent to the same account")
 	passwordValidationRegex0 := flag.String("password-validation-regex", "^.{6,30}$", "Password validation regex. Defaults to '^.{6,30}$'")
 	mailFromName0 := flag.String("mail-from-name", "", "Mail from name on mail notifications. Used as JWT Issuer field too. required")
 	jwtSigningMethod0 := flag.String("jwt-signing-method", "", "JWT signing method. required")
+	tokenSubject0 := flag.String("token-subject", "id", "Value of the 'sub' claim of access and refresh tokens. One of 'id' (immutable user id. The email is in the 'email' claim) or 'email' (legacy behaviour)")
+	passwordPolicy0 := flag.String("password-policy", "", "JSON password policy applied along with --password-validation-regex, as in {\"minLength\": 8, \"maxLength\": 128, \"minCharClasses\": 3, \"minStrength\": 3, \"rejectPersonalInfo\": true, \"rejectCommon\": true, \"rejectBreached\": true, \"expireBreached\": true}. Only the regex is used if empty")
+	passwordDictionaryFile0 := flag.String("password-dictionary-file", "", "File with common passwords (one per line) rejected and considered weak along with the bundled ones")
+	breachedPasswordDataset0 := flag.String("breached-password-dataset", "", "Pwned Passwords dataset (SHA-1 or NTLM 'HASH:COUNT' lines ordered by hash) used for rejecting breached passwords offline. Converted to a compact index in '<file>.idx' on startup")
+	breachedPasswordAPIURL0 := flag.String("breached-password-api-url", "", "Pwned Passwords range API used for rejecting breached passwords, as in https://api.pwnedpasswords.com/range. Only the first 5 characters of the password SHA-1 are sent")
+	breachedPasswordAPITimeout0 := flag.Int("breached-password-api-timeout", 2000, "Breached passwords API timeout in milliseconds. Passwords are accepted if the API fails")
+	attributesSchema0 := flag.String("attributes-schema", "", "JSON schema of user custom attributes, as in {\"department\": {\"type\": \"string\", \"required\": false, \"pattern\": \"^.{2,40}$\", \"claim\": \"dept\"}}. Types are 'string', 'number' or 'boolean'. Attributes with 'claim' are added to access tokens. Custom attributes are rejected if empty")
 	jwtSigningKeyFile0 := flag.String("jwt-signing-key-file", "", "Key file used to sign tokens. Tokens may be later validated by thirdy parties by checking the signature with related public key when usign assymetric keys")
+	blobStorage0 := flag.String("blob-storage", "local", "Where binary objects such as avatars are stored. One of 'local' (directory in local filesystem) or 's3' (S3 compatible storage, such as AWS S3 or MinIO)")
+	blobStorageDir0 := flag.String("blob-storage-dir", "/data/blobs", "Directory used by 'local' blob storage")
+	s3Endpoint0 := flag.String("s3-endpoint", "", "S3 endpoint url for 's3' blob storage. Ex.: 'https://s3.us-east-1.amazonaws.com' or 'http://minio:9000'")
+	s3Region0 := flag.String("s3-region", "us-east-1", "S3 region used in request signatures")
+	s3Bucket0 := flag.String("s3-bucket", "", "S3 bucket in which blobs are stored")
+	s3AccessKey0 := flag.String("s3-access-key", "", "S3 access key id")
+	s3SecretKey0 := flag.String("s3-secret-key", "", "S3 secret access key")
+	avatarMaxSizeBytes0 := flag.Int("avatar-max-size-bytes", 5*1024*1024, "Max size of uploaded avatar images")
+	avatarSizePixels0 := flag.Int("avatar-size-pixels", 256, "Avatars are cropped to a square and resized to this width/height")
+	accountDeletionGraceDays0 := flag.Int("account-deletion-grace-days", 14, "Days between an account deletion request (when the account is disabled) and its erasure. The user may cancel the deletion during this period")
+	webhookMaxAttempts0 := flag.Int("webhook-max-attempts", 8, "Delivery attempts of a webhook event before it goes to the dead letter")
+	webhookRetrySeconds0 := flag.Int("webhook-retry-seconds", 30, "Delay before the first retry of a failed webhook delivery. Doubles on each following retry")
+	preSignupHookURL0 := flag.String("pre-signup-hook-url", "", "URL called synchronously before accounts are created. It may deny the signup")
+	preSignupHookTimeout0 := flag.Int("pre-signup-hook-timeout", 3000, "Pre-signup hook timeout in milliseconds")
+	preSignupHookFailPolicy0 := flag.String("pre-signup-hook-fail-policy", "closed", "What to do when the pre-signup hook fails or times out. 'open' (signup proceeds) or 'closed' (signup is denied)")
+	preTokenHookURL0 := flag.String("pre-token-hook-url", "", "URL called synchronously before tokens are issued. It may deny the login or add access token claims")
+	preTokenHookTimeout0 := flag.Int("pre-token-hook-timeout", 3000, "Pre-token hook timeout in milliseconds")
+	preTokenHookFailPolicy0 := flag.String("pre-token-hook-fail-policy", "closed", "What to do when the pre-token hook fails or times out. 'open' (tokens are issued) or 'closed' (tokens are denied)")
+	hooksSecret0 := flag.String("hooks-secret", "", "Secret used to sign pre-signup and pre-token hook requests. Requests are not signed if empty")
+	eventBroker0 := flag.String("event-broker", "", "Message broker domain events are published to. One of 'nats' or 'memory' (development only). Disabled if empty")
+	eventBrokerURL0 := flag.String("event-broker-url", "nats://localhost:4222", "Event broker address, as in nats://[user:pass@]host:port")
+	eventBrokerRetrySeconds0 := flag.Int("event-broker-retry-seconds", 5, "Delay before retrying to publish events after a broker failure")
+	eventSubjectPrefix0 := flag.String("event-subject-prefix", "userme", "Prefix of the subjects events are published to. Subjects are '<prefix>.<realm>.<event type>'")
+	auditRetentionDays0 := flag.Int("audit-retention-days", 0, "Days audit events are kept. Use 0 to keep them forever")
+	accountDeletionMode0 := flag.String("account-deletion-mode", "delete", "How accounts are erased after the deletion grace period. One of 'delete' (user row is removed) or 'anonymize' (user row and id are kept with all personal data cleared)")
 	masterPublicKeyFile0 := flag.String("master-public-key-file", "", "Public key file used to sign special master tokens that can be used to perform special operations on userme.")
 
 	mailSMTPHost0 := flag.String("mail-smtp-host", "", "Mail smtp host")
@@ -98,6 +231,24 @@ func main() {
 	mailActivationHTML0 := flag.String("mail-activation-html", "", "Mail activation html body. Use placeholders EMAIL, DISPLAY_NAME and ACTIVATION_TOKEN as templating")
 	mailResetPasswordSubject0 := flag.String("mail-password-reset-subject", "", "Mail password reset subject")
 	mailResetPasswordHTML0 := flag.String("mail-password-reset-html", "", "Mail password reset html body. Use placeholders EMAIL, DISPLAY_NAME and ACTIVATION_TOKEN as templating")
+	mailInvitationSubject0 := flag.String("mail-invitation-subject", "", "Mail invitation subject")
+	mailInvitationHTML0 := flag.String("mail-invitation-html", "", "Mail invitation html body. Use placeholders EMAIL, ORGANIZATION_NAME and INVITATION_TOKEN as templating")
+	mailApprovalSubject0 := flag.String("mail-approval-subject", "", "Mail account approved subject")
+	mailApprovalHTML0 := flag.String("mail-approval-html", "", "Mail account approved html body. Use placeholders EMAIL and DISPLAY_NAME as templating")
+	mailRejectionSubject0 := flag.String("mail-rejection-subject", "", "Mail account rejected subject")
+	mailRejectionHTML0 := flag.String("mail-rejection-html", "", "Mail account rejected html body. Use placeholders EMAIL and DISPLAY_NAME as templating")
+	mailEmailChangeSubject0 := flag.String("mail-email-change-subject", "", "Mail email change confirmation subject (sent to the new email)")
+	mailEmailChangeHTML0 := flag.String("mail-email-change-html", "", "Mail email change confirmation html body. Use placeholders EMAIL, NEW_EMAIL, DISPLAY_NAME and EMAIL_CHANGE_TOKEN as templating")
+	mailEmailChangeNotificationSubject0 := flag.String("mail-email-change-notification-subject", "", "Mail email change notification subject (sent to the old email)")
+	mailAccountDeletionSubject0 := flag.String("mail-account-deletion-subject", "", "Mail account deletion confirmation subject")
+	mailAccountDeletionHTML0 := flag.String("mail-account-deletion-html", "", "Mail account deletion confirmation html body. Use placeholders EMAIL, DISPLAY_NAME, DELETION_DATE and ACCOUNT_DELETION_CANCEL_TOKEN as templating")
+	mailNewSigninSubject0 := flag.String("mail-new-signin-subject", "", "Mail new signin notification subject. Sent when a user signs in from a device and network not seen before. Not sent if empty")
+	mailNewSigninHTML0 := flag.String("mail-new-signin-html", "", "Mail new signin notification html body. Use placeholders EMAIL, DISPLAY_NAME, DEVICE_NAME, CLIENT_IP and SIGNIN_DATE as templating")
+	mailPasswordExpirationSubject0 := flag.String("mail-password-expiration-subject", "", "Mail password expiration warning subject. Sent --password-expiration-warning-days before passwords expire. Not sent if empty")
+	mailPasswordExpirationHTML0 := flag.String("mail-password-expiration-html", "", "Mail password expiration warning html body. Use placeholders EMAIL, DISPLAY_NAME, EXPIRATION_DATE and DAYS_LEFT as templating")
+	mailAccountLockedSubject0 := flag.String("mail-account-locked-subject", "", "Mail account locked notification subject. Sent when an account is locked by wrong passwords. Not sent if empty")
+	mailAccountLockedHTML0 := flag.String("mail-account-locked-html", "", "Mail account locked notification html body. Use placeholders EMAIL, DISPLAY_NAME, LOCK_DATE, CLIENT_IP and UNLOCK_TOKEN as templating")
+	mailEmailChangeNotificationHTML0 := flag.String("mail-email-change-notification-html", "", "Mail email change notification html body. Use placeholders EMAIL, NEW_EMAIL, DISPLAY_NAME and EMAIL_CHANGE_UNDO_TOKEN as templating")
 	mailTokensTests0 := flag.String("mail-tokens-tests", "", "Send mail tokens to response headers. Useful for testing enviroments. NEVER use this in production as this makes second factor (e-mail) invalid for our application.")
 
 	facebookClientID0 := flag.String("facebook-client-id", "", "Facebook Application Client ID")
@@ -136,27 +287,102 @@ func main() {
 		refreshTokenDefaultExpirationMinutes: *refreshTokenDefaultExpirationMinutes0,
 		validationTokenExpirationMinutes:     *validationTokenExpirationMinutes0,
 		passwordResetTokenExpirationMinutes:  *passwordResetTokenExpirationMinutes0,
+		invitationTokenExpirationMinutes:     *invitationTokenExpirationMinutes0,
+		emailChangeUndoExpirationMinutes:     *emailChangeUndoExpirationMinutes0,
 		accessTokenDefaultScope:              *accessTokenDefaultScope0,
 		mailFromName:                         *mailFromName0,
 		jwtSigningMethod:                     *jwtSigningMethod0,
+		tokenSubject:                         *tokenSubject0,
+		attributesSchema:                     *attributesSchema0,
+		passwordPolicy:                       *passwordPolicy0,
+		passwordDictionaryFile:               *passwordDictionaryFile0,
+		breachedPasswordDataset:              *breachedPasswordDataset0,
+		breachedPasswordAPIURL:               *breachedPasswordAPIURL0,
+		breachedPasswordAPITimeout:           *breachedPasswordAPITimeout0,
 		jwtSigningKeyFile:                    *jwtSigningKeyFile0,
 		masterPublicKeyFile:                  *masterPublicKeyFile0,
+		blobStorage:                          *blobStorage0,
+		blobStorageDir:                       *blobStorageDir0,
+		s3Endpoint:                           *s3Endpoint0,
+		s3Region:                             *s3Region0,
+		s3Bucket:                             *s3Bucket0,
+		s3AccessKey:                          *s3AccessKey0,
+		s3SecretKey:                          *s3SecretKey0,
+		avatarMaxSizeBytes:                   *avatarMaxSizeBytes0,
+		avatarSizePixels:                     *avatarSizePixels0,
+		accountDeletionGraceDays:             *accountDeletionGraceDays0,
+		auditRetentionDays:                   *auditRetentionDays0,
+		webhookMaxAttempts:                   *webhookMaxAttempts0,
+		webhookRetrySeconds:                  *webhookRetrySeconds0,
+		preSignupHookURL:                     *preSignupHookURL0,
+		preSignupHookTimeout:                 *preSignupHookTimeout0,
+		preSignupHookFailPolicy:              *preSignupHookFailPolicy0,
+		preTokenHookURL:                      *preTokenHookURL0,
+		preTokenHookTimeout:                  *preTokenHookTimeout0,
+		preTokenHookFailPolicy:               *preTokenHookFailPolicy0,
+		hooksSecret:                          *hooksSecret0,
+		eventBroker:                          *eventBroker0,
+		eventBrokerURL:                       *eventBrokerURL0,
+		eventBrokerRetrySeconds:              *eventBrokerRetrySeconds0,
+		eventSubjectPrefix:                   *eventSubjectPrefix0,
+		accountDeletionMode:                  *accountDeletionMode0,
 		passwordRetriesMax:                   *passwordRetriesMax0,
+		passwordHashAlgorithm:                *passwordHashAlgorithm0,
+		passwordBcryptCost:                   *passwordBcryptCost0,
+		passwordArgon2Memory:                 *passwordArgon2Memory0,
+		passwordArgon2Iterations:             *passwordArgon2Iterations0,
+		passwordArgon2Parallelism:            *passwordArgon2Parallelism0,
+		passwordScryptCost:                   *passwordScryptCost0,
+		passwordPepper:                       *passwordPepper0,
 		passwordRetriesTimeSeconds:           *passwordRetriesTimeSeconds0,
+		passwordLockoutMinutes:               *passwordLockoutMinutes0,
+		unlockTokenExpirationMinutes:         *unlockTokenExpirationMinutes0,
+		trustedProxies:                       *trustedProxies0,
+		ipFailuresWindowMinutes:              *ipFailuresWindowMinutes0,
+		ipFailuresDelayThreshold:             *ipFailuresDelayThreshold0,
+		ipFailuresDelaySeconds:               *ipFailuresDelaySeconds0,
+		ipFailuresBanThreshold:               *ipFailuresBanThreshold0,
+		subnetFailuresDelayThreshold:         *subnetFailuresDelayThreshold0,
+		subnetFailuresBanThreshold:           *subnetFailuresBanThreshold0,
+		ipBanMinutes:                         *ipBanMinutes0,
 		accountActivationMethod:              *accountActivationMethod0,
+		signupMethod:                         *signupMethod0,
+		activationTokenFormat:                *activationTokenFormat0,
+		activationResendIntervalSeconds:      *activationResendIntervalSeconds0,
 		passwordValidationRegex:              *passwordValidationRegex0,
 		passwordExpirationDays:               *passwordExpirationDays0,
+		passwordExpirationWarningDays:        *passwordExpirationWarningDays0,
+		passwordHistorySize:                  *passwordHistorySize0,
+		passwordMinAgeHours:                  *passwordMinAgeHours0,
 
-		mailSMTPHost:              *mailSMTPHost0,
-		mailSMTPPort:              *mailSMTPPort0,
-		mailSMTPUser:              *mailSMTPUser0,
-		mailSMTPPass:              *mailSMTPPass0,
-		mailFromAddress:           *mailFromAddress0,
-		mailResetPasswordSubject:  *mailResetPasswordSubject0,
-		mailResetPasswordHTMLBody: *mailResetPasswordHTML0,
-		mailActivationSubject:     *mailActivationSubject0,
-		mailActivationHTMLBody:    *mailActivationHTML0,
-		mailTokensTests:           *mailTokensTests0,
+		mailSMTPHost:                        *mailSMTPHost0,
+		mailSMTPPort:                        *mailSMTPPort0,
+		mailSMTPUser:                        *mailSMTPUser0,
+		mailSMTPPass:                        *mailSMTPPass0,
+		mailFromAddress:                     *mailFromAddress0,
+		mailResetPasswordSubject:            *mailResetPasswordSubject0,
+		mailResetPasswordHTMLBody:           *mailResetPasswordHTML0,
+		mailActivationSubject:               *mailActivationSubject0,
+		mailActivationHTMLBody:              *mailActivationHTML0,
+		mailInvitationSubject:               *mailInvitationSubject0,
+		mailInvitationHTMLBody:              *mailInvitationHTML0,
+		mailApprovalSubject:                 *mailApprovalSubject0,
+		mailApprovalHTMLBody:                *mailApprovalHTML0,
+		mailRejectionSubject:                *mailRejectionSubject0,
+		mailRejectionHTMLBody:               *mailRejectionHTML0,
+		mailEmailChangeSubject:              *mailEmailChangeSubject0,
+		mailEmailChangeHTMLBody:             *mailEmailChangeHTML0,
+		mailEmailChangeNotificationSubject:  *mailEmailChangeNotificationSubject0,
+		mailEmailChangeNotificationHTMLBody: *mailEmailChangeNotificationHTML0,
+		mailAccountDeletionSubject:          *mailAccountDeletionSubject0,
+		mailAccountDeletionHTMLBody:         *mailAccountDeletionHTML0,
+		mailNewSigninSubject:                *mailNewSigninSubject0,
+		mailNewSigninHTMLBody:               *mailNewSigninHTML0,
+		mailPasswordExpirationSubject:       *mailPasswordExpirationSubject0,
+		mailPasswordExpirationHTMLBody:      *mailPasswordExpirationHTML0,
+		mailAccountLockedSubject:            *mailAccountLockedSubject0,
+		mailAccountLockedHTMLBody:           *mailAccountLockedHTML0,
+		mailTokensTests:                     *mailTokensTests0,
 
 		googleClientID:       *googleClientID0,
 		googleClientSecret:   *googleClientSecret0,
@@ -181,13 +407,102 @@ func main() {
 		os.Exit(1)
 	}
 
-	if opt.accountActivationMethod == "mail" {
+	if !isOneOf(opt.accountActivationMethod, activationMethods) {
+		logrus.Errorf("--account-activation-method must be one of 'direct', 'mail', 'approval' or 'mail+approval'")
+		os.Exit(1)
+	}
+
+	if strings.HasPrefix(opt.accountActivationMethod, "mail") {
 		if opt.mailActivationSubject == "" || opt.mailActivationHTMLBody == "" {
-			logrus.Errorf("--mail-activation-subject and --mail-activation-html must be non empty when activation method is 'mail'")
+			logrus.Errorf("--mail-activation-subject and --mail-activation-html must be non empty when activation method is 'mail' or 'mail+approval'")
+			os.Exit(1)
+		}
+	}
+
+	if strings.HasSuffix(opt.accountActivationMethod, "approval") {
+		if opt.mailApprovalSubject == "" || opt.mailApprovalHTMLBody == "" || opt.mailRejectionSubject == "" || opt.mailRejectionHTMLBody == "" {
+			logrus.Errorf("--mail-approval-subject, --mail-approval-html, --mail-rejection-subject and --mail-rejection-html must be non empty when activation method is 'approval' or 'mail+approval'")
+			os.Exit(1)
+		}
+	}
+
+	if !isOneOf(opt.tokenSubject, tokenSubjects) {
+		logrus.Errorf("--token-subject must be one of 'id' or 'email'")
+		os.Exit(1)
+	}
+
+	_, errs := parseAttributesSchema(opt.attributesSchema)
+	if errs != nil {
+		logrus.Errorf("Invalid --attributes-schema. err=%s", errs)
+		os.Exit(1)
+	}
+
+	if opt.breachedPasswordDataset != "" {
+		breachedPasswords, errs = openBreachedPasswordsDataset(opt.breachedPasswordDataset)
+		if errs != nil {
+			logrus.Errorf("Couldn't load --breached-password-dataset. err=%s", errs)
 			os.Exit(1)
 		}
 	}
 
+	_, errs = parsePasswordPolicy(opt.passwordPolicy)
+	if errs != nil {
+		logrus.Errorf("Invalid --password-policy. err=%s", errs)
+		os.Exit(1)
+	}
+
+	errs = loadCommonPasswords(opt.passwordDictionaryFile)
+	if errs != nil {
+		logrus.Errorf("Couldn't load --password-dictionary-file. err=%s", errs)
+		os.Exit(1)
+	}
+
+	trustedProxies, errs = parseTrustedProxies(opt.trustedProxies)
+	if errs != nil {
+		logrus.Errorf("Invalid --trusted-proxies. err=%s", errs)
+		os.Exit(1)
+	}
+
+	if opt.ipFailuresWindowMinutes <= 0 || opt.ipFailuresDelaySeconds <= 0 || opt.ipBanMinutes <= 0 {
+		logrus.Errorf("--ip-failures-window-minutes, --ip-failures-delay-seconds and --ip-ban-minutes must be greater than 0")
+		os.Exit(1)
+	}
+
+	if opt.passwordHistorySize < 0 || opt.passwordMinAgeHours < 0 {
+		logrus.Errorf("--password-history-size and --password-min-age-hours can't be negative")
+		os.Exit(1)
+	}
+
+	if !isOneOf(opt.activationTokenFormat, activationTokenFormats) {
+		logrus.Errorf("--activation-token-format must be one of 'jwt' or 'code'")
+		os.Exit(1)
+	}
+
+	if !isOneOf(opt.signupMethod, signupMethods) {
+		logrus.Errorf("--signup-method must be one of 'open' or 'invitation'")
+		os.Exit(1)
+	}
+
+	_, errh := newPasswordHasher(opt.passwordHashAlgorithm)
+	if errh != nil {
+		logrus.Errorf("Invalid password hashing configuration. err=%s", errh)
+		os.Exit(1)
+	}
+
+	blobs0, errb := newBlobStorage()
+	if errb != nil {
+		logrus.Errorf("Couldn't init blob storage. err=%s", errb)
+		os.Exit(1)
+	}
+	blobs = blobs0
+
+	broker0, errb := newEventBroker()
+	if errb != nil {
+		logrus.Errorf("Couldn't init event broker. err=%s", errb)
+		os.Exit(1)
+	}
+	broker = broker0
+
 	if opt.googleClientID == "" || opt.googleClientSecret == "" {
 		logrus.Warnf("Disabling Google login support. Google client id and secret were not defined.")
 	}
@@ -196,6 +511,28 @@ func main() {
 		logrus.Warnf("Disabling Facebook login support. Facebook client id and secret were not defined.")
 	}
 
+	if opt.mailInvitationSubject == "" || opt.mailInvitationHTMLBody == "" {
+		logrus.Warnf("Disabling invitations. --mail-invitation-subject and --mail-invitation-html were not defined.")
+	}
+
+	if opt.mailEmailChangeSubject == "" || opt.mailEmailChangeHTMLBody == "" || opt.mailEmailChangeNotificationSubject == "" || opt.mailEmailChangeNotificationHTMLBody == "" {
+		logrus.Warnf("Disabling email change. --mail-email-change-subject, --mail-email-change-html, --mail-email-change-notification-subject and --mail-email-change-notification-html were not defined.")
+	}
+
+	if opt.mailAccountDeletionSubject == "" || opt.mailAccountDeletionHTMLBody == "" {
+		logrus.Warnf("Account deletion requests won't send confirmation mails and can't be cancelled. --mail-account-deletion-subject and --mail-account-deletion-html were not defined.")
+	}
+
+	if !isOneOf(opt.preSignupHookFailPolicy, hookFailPolicies) || !isOneOf(opt.preTokenHookFailPolicy, hookFailPolicies) {
+		logrus.Errorf("--pre-signup-hook-fail-policy and --pre-token-hook-fail-policy must be one of 'open' or 'closed'")
+		os.Exit(1)
+	}
+
+	if !isOneOf(opt.accountDeletionMode, accountDeletionModes) {
+		logrus.Errorf("--account-deletion-mode must be one of 'delete' or 'anonymize'")
+		os.Exit(1)
+	}
+
 	sm := jwt.GetSigningMethod(opt.jwtSigningMethod)
 	if sm == nil {
 		logrus.Errorf("Unsupported JWT signing method %s", opt.jwtSigningMethod)
@@ -225,6 +562,16 @@ func main() {
 	}
 	logrus.Debugf("JWT key loaded")
 
+	if opt.masterPublicKeyFile != "" {
+		logrus.Infof("Loading master public key")
+		mpubk, err := utils.ParseKeyFromPEM(opt.masterPublicKeyFile, false)
+		if err != nil {
+			logrus.Warnf("Couldn't load master public key. Admin APIs will be disabled. err=%s", err)
+		} else {
+			opt.masterPublicKey = mpubk
+		}
+	}
+
 	opt.jwtIssuer = opt.mailFromName
 
 	db0, err0 := initDB()
@@ -235,6 +582,25 @@ func main() {
 	db = db0
 	defer db.Close()
 
+	err1 := syncDefaultRealm()
+	if err1 != nil {
+		logrus.Warnf("Couldn't save default realm. err=%s", err1)
+		os.Exit(1)
+	}
+
+	go runAccountDeletionWorker()
+	go runWebhookDeliveryWorker()
+	if broker != nil {
+		defer broker.Close()
+		go runOutboxPublisher()
+	}
+	if opt.auditRetentionDays > 0 {
+		go runAuditRetentionWorker()
+	}
+	if opt.passwordExpirationWarningDays > 0 {
+		go runPasswordExpirationMailWorker()
+	}
+
 	err := NewHTTPServer().Start()
 	if err != nil {
 		logrus.Warnf("Error starting server. err=%s", err)
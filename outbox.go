@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+//saveOutboxEvent records a domain event in the outbox using the transaction of the change that caused it, so events are never lost nor published for changes that were rolled back. Does nothing if event streaming is disabled
+func saveOutboxEvent(tx *gorm.DB, realm string, eventType string, data map[string]interface{}) error {
+	if broker == nil {
+		return nil
+	}
+	now := time.Now()
+	ev := OutboxEvent{
+		ID:           uuid.New().String(),
+		Realm:        realm,
+		Type:         eventType,
+		CreationDate: now,
+	}
+	payload, err := json.Marshal(gin.H{"id": ev.ID, "type": eventType, "realm": realm, "date": now.Format(time.RFC3339), "data": data})
+	if err != nil {
+		return err
+	}
+	ev.Payload = string(payload)
+	return tx.Create(&ev).Error
+}
+
+//runOutboxPublisher relays outbox events to the event broker in creation order. Events are marked as published only after the broker acknowledged them, so they are delivered at least once. On failures, publishing stops and is retried later from the same event
+func runOutboxPublisher() {
+	for {
+		evs := make([]OutboxEvent, 0)
+		err := db.Order("creation_date").Limit(100).Find(&evs, "publish_date IS NULL").Error
+		if err != nil {
+			logrus.Warnf("Couldn't load outbox events. err=%s", err)
+		}
+		published := 0
+		for _, ev := range evs {
+			err = publishOutboxEvent(ev)
+			if err != nil {
+				break
+			}
+			published++
+		}
+		if len(evs) == 100 && published == 100 {
+			continue
+		}
+
+		cleanupDate := time.Now().Add(-7 * 24 * time.Hour)
+		err = db.Delete(OutboxEvent{}, "publish_date < ?", cleanupDate).Error
+		if err != nil {
+			logrus.Warnf("Couldn't remove old outbox events. err=%s", err)
+		}
+
+		if published < len(evs) {
+			time.Sleep(time.Duration(opt.eventBrokerRetrySeconds) * time.Second)
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+func publishOutboxEvent(ev OutboxEvent) error {
+	subject := opt.eventSubjectPrefix + "." + ev.Realm + "." + ev.Type
+	err := broker.Publish(subject, []byte(ev.Payload))
+	if err != nil {
+		logrus.Warnf("Couldn't publish event %s %s to broker. Retrying in %ds. err=%s", ev.Type, ev.ID, opt.eventBrokerRetrySeconds, err)
+		db.Model(&OutboxEvent{}).Where("id = ?", ev.ID).UpdateColumns(map[string]interface{}{"attempts": ev.Attempts + 1, "last_error": truncate(err.Error(), 255)})
+		eventCounter.WithLabelValues(ev.Type, "error").Inc()
+		return err
+	}
+	logrus.Debugf("Event %s %s published to %s", ev.Type, ev.ID, subject)
+	eventCounter.WithLabelValues(ev.Type, "published").Inc()
+	//a failure here only makes the event be published again, which at least once delivery allows
+	err = db.Model(&OutboxEvent{}).Where("id = ?", ev.ID).UpdateColumns(map[string]interface{}{"publish_date": time.Now(), "attempts": ev.Attempts + 1, "last_error": ""}).Error
+	if err != nil {
+		logrus.Warnf("Couldn't mark outbox event %s as published. err=%s", ev.ID, err)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+//passwordHasher creates self describing password hashes, which carry the algorithm and all the parameters needed to verify them
+type passwordHasher interface {
+	//Hash encodes a new hash of password with the configured parameters
+	Hash(password []byte) (string, error)
+	//Verify compares password with a hash encoded by this algorithm, whatever parameters it was created with
+	Verify(password []byte, encoded string) (bool, error)
+	//Outdated returns true if the hash parameters differ from the configured ones
+	Outdated(encoded string) bool
+}
+
+var passwordHashAlgorithms = []string{"bcrypt", "argon2id", "scrypt"}
+
+//pepperedPrefix marks hashes of passwords combined with the server side pepper (HMAC-SHA256 of the password keyed by --password-pepper)
+const pepperedPrefix = "$peppered"
+
+//newPasswordHasher returns the hasher of an algorithm with the parameters configured by flags
+func newPasswordHasher(algorithm string) (passwordHasher, error) {
+	switch algorithm {
+	case "bcrypt":
+		if opt.passwordBcryptCost < bcrypt.MinCost || opt.passwordBcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("--password-bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return &bcryptHasher{cost: opt.passwordBcryptCost}, nil
+	case "argon2id":
+		if opt.passwordArgon2Memory < 8*opt.passwordArgon2Parallelism || opt.passwordArgon2Iterations < 1 || opt.passwordArgon2Parallelism < 1 || opt.passwordArgon2Parallelism > 255 {
+			return nil, fmt.Errorf("Invalid argon2id parameters. Memory must be at least 8*parallelism KiB, iterations at least 1 and parallelism between 1 and 255")
+		}
+		return &argon2idHasher{memory: uint32(opt.passwordArgon2Memory), iterations: uint32(opt.passwordArgon2Iterations), parallelism: uint8(opt.passwordArgon2Parallelism)}, nil
+	case "scrypt":
+		if opt.passwordScryptCost < 10 || opt.passwordScryptCost > 20 {
+			return nil, fmt.Errorf("--password-scrypt-cost must be between 10 and 20")
+		}
+		return &scryptHasher{logN: opt.passwordScryptCost, r: 8, p: 1}, nil
+	}
+	return nil, fmt.Errorf("Invalid password hash algorithm '%s'. Use one of %s", algorithm, strings.Join(passwordHashAlgorithms, ", "))
+}
+
+//hashPassword hashes a password with the algorithm selected by --password-hash-algorithm, peppered if --password-pepper is set
+func hashPassword(password string) (string, error) {
+	h, err := newPasswordHasher(opt.passwordHashAlgorithm)
+	if err != nil {
+		return "", err
+	}
+	if opt.passwordPepper == "" {
+		return h.Hash([]byte(password))
+	}
+	encoded, err := h.Hash(pepperPassword(password))
+	return pepperedPrefix + encoded, err
+}
+
+//verifyPassword compares a password with a stored hash of any supported algorithm. 'rehash' is true when the password is valid but its hash should be replaced
+//because the algorithm, its parameters or the pepper setting changed. Hashes without a known algorithm (as the empty hash of social login accounts) never match
+func verifyPassword(password string, encoded string) (valid bool, rehash bool, err error) {
+	peppered := strings.HasPrefix(encoded, pepperedPrefix)
+	pwd := []byte(password)
+	if peppered {
+		if opt.passwordPepper == "" {
+			return false, false, fmt.Errorf("Hash is peppered but --password-pepper is not set")
+		}
+		encoded = strings.TrimPrefix(encoded, pepperedPrefix)
+		pwd = pepperPassword(password)
+	}
+
+	algorithm := passwordHashAlgorithm(encoded)
+	if algorithm == "" {
+		return false, false, nil
+	}
+	h, err := newPasswordHasher(algorithm)
+	if err != nil {
+		return false, false, err
+	}
+	valid, err = h.Verify(pwd, encoded)
+	if err != nil || !valid {
+		return false, false, err
+	}
+	rehash = algorithm != opt.passwordHashAlgorithm || h.Outdated(encoded) || peppered != (opt.passwordPepper != "")
+	return true, rehash, nil
+}
+
+//validUserPassword verifies the password of a user. Valid passwords with outdated hashes are transparently rehashed with the current algorithm and parameters
+func validUserPassword(u *User, password string) bool {
+	valid, rehash, err := verifyPassword(password, u.PasswordHash)
+	if err != nil {
+		logrus.Warnf("Couldn't verify password of %s. err=%s", u.Email, err)
+		return false
+	}
+	if !valid || !rehash {
+		return valid
+	}
+	phash, err := hashPassword(password)
+	if err == nil {
+		err = db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("password_hash", phash).Error
+	}
+	if err != nil {
+		logrus.Warnf("Couldn't rehash password of %s. err=%s", u.Email, err)
+		return true
+	}
+	logrus.Infof("Password hash of %s upgraded to %s", u.Email, opt.passwordHashAlgorithm)
+	passwordRehashCounter.WithLabelValues(opt.passwordHashAlgorithm).Inc()
+	u.PasswordHash = phash
+	return true
+}
+
+//passwordHashAlgorithm identifies the algorithm of an encoded hash
+func passwordHashAlgorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$"):
+		return "bcrypt"
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return "argon2id"
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		return "scrypt"
+	}
+	return ""
+}
+
+//pepperPassword combines the password with the pepper. The result is hex encoded so it fits the 72 bytes bcrypt limit
+func pepperPassword(password string) []byte {
+	mac := hmac.New(sha256.New, []byte(opt.passwordPepper))
+	mac.Write([]byte(password))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Hash(password []byte) (string, error) {
+	phash, err := bcrypt.GenerateFromPassword(password, h.cost)
+	return string(phash), err
+}
+
+func (h *bcryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (h *bcryptHasher) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.cost
+}
+
+//argon2idHasher encodes hashes in the PHC string format used by the reference implementation, as in $argon2id$v=19$m=65536,t=3,p=2$<salt>$<hash>
+type argon2idHasher struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func (h *argon2idHasher) Hash(password []byte) (string, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, h.iterations, h.memory, h.parallelism, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, h.memory, h.iterations, h.parallelism, b64(salt), b64(key)), nil
+}
+
+func (h *argon2idHasher) Verify(password []byte, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey(password, salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *argon2idHasher) Outdated(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	return err != nil || *p != *h
+}
+
+func (h *argon2idHasher) decode(encoded string) (*argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, fmt.Errorf("Invalid argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("Unsupported argon2id version %s", parts[2])
+	}
+	p := argon2idHasher{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Invalid argon2id parameters. err=%s", err)
+	}
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	return &p, salt, key, err
+}
+
+//scryptHasher encodes hashes in the PHC string format, as in $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+type scryptHasher struct {
+	logN int
+	r    int
+	p    int
+}
+
+func (h *scryptHasher) Hash(password []byte) (string, error) {
+	salt, err := randomSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(password, salt, 1<<uint(h.logN), h.r, h.p, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", h.logN, h.r, h.p, b64(salt), b64(key)), nil
+}
+
+func (h *scryptHasher) Verify(password []byte, encoded string) (bool, error) {
+	p, salt, key, err := h.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key(password, salt, 1<<uint(p.logN), p.r, p.p, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *scryptHasher) Outdated(encoded string) bool {
+	p, _, _, err := h.decode(encoded)
+	return err != nil || *p != *h
+}
+
+func (h *scryptHasher) decode(encoded string) (*scryptHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return nil, nil, nil, fmt.Errorf("Invalid scrypt hash")
+	}
+	p := scryptHasher{}
+	_, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &p.logN, &p.r, &p.p)
+	if err != nil || p.logN < 1 || p.logN > 30 {
+		return nil, nil, nil, fmt.Errorf("Invalid scrypt parameters %s", parts[2])
+	}
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	return &p, salt, key, err
+}
+
+func randomSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+//b64 is the unpadded standard base64 of PHC strings
+func b64(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
+
+func decodeSaltAndKey(salt64 string, key64 string) ([]byte, []byte, error) {
+	salt, err := base64.RawStdEncoding.DecodeString(salt64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid hash salt. err=%s", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(key64)
+	if err != nil || len(key) == 0 {
+		return nil, nil, fmt.Errorf("Invalid hash key")
+	}
+	return salt, key, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+)
+
+//savePasswordHistory records a new password hash of the user and removes the ones older than the last --password-history-size
+func savePasswordHistory(tx *gorm.DB, u *User, passwordHash string) error {
+	if opt.passwordHistorySize <= 0 {
+		return nil
+	}
+	err := tx.Create(&PasswordHistory{
+		ID:           uuid.New().String(),
+		Realm:        u.Realm,
+		UserID:       u.ID,
+		PasswordHash: passwordHash,
+		CreationDate: time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	history := make([]PasswordHistory, 0)
+	err = tx.Select("id").Order("creation_date DESC").Find(&history, "user_id = ?", u.ID).Error
+	if err != nil || len(history) <= opt.passwordHistorySize {
+		return err
+	}
+	ids := make([]string, 0)
+	for _, ph := range history[opt.passwordHistorySize:] {
+		ids = append(ids, ph.ID)
+	}
+	return tx.Delete(PasswordHistory{}, "id IN (?)", ids).Error
+}
+
+//passwordReused returns true if the password matches the current password of the user or one of the last --password-history-size ones
+func passwordReused(u *User, password string) (bool, error) {
+	if opt.passwordHistorySize <= 0 {
+		return false, nil
+	}
+	hashes := []string{u.PasswordHash}
+	history := make([]PasswordHistory, 0)
+	err := db.Order("creation_date DESC").Limit(opt.passwordHistorySize).Find(&history, "user_id = ?", u.ID).Error
+	if err != nil {
+		return false, err
+	}
+	for _, ph := range history {
+		if ph.PasswordHash != u.PasswordHash {
+			hashes = append(hashes, ph.PasswordHash)
+		}
+	}
+	for _, h := range hashes {
+		valid, _, err := verifyPassword(password, h)
+		if err != nil {
+			logrus.Debugf("Couldn't verify password history of %s. err=%s", u.Email, err)
+			continue
+		}
+		if valid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
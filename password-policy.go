@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//passwordPolicy describes the passwords accepted in a realm, in the format {"minLength": 8, "maxLength": 128, "minCharClasses": 3, "minStrength": 3, "rejectPersonalInfo": true, "rejectCommon": true, "rejectBreached": true, "expireBreached": true}.
+//Zero values disable each rule. The realm password validation regex is applied too
+type passwordPolicy struct {
+	MinLength          int  `json:"minLength"`
+	MaxLength          int  `json:"maxLength"`
+	MinCharClasses     int  `json:"minCharClasses"`
+	MinStrength        int  `json:"minStrength"`
+	RejectPersonalInfo bool `json:"rejectPersonalInfo"`
+	RejectCommon       bool `json:"rejectCommon"`
+	RejectBreached     bool `json:"rejectBreached"`
+	ExpireBreached     bool `json:"expireBreached"`
+}
+
+//passwordViolation is a machine readable reason for a password rejection. Codes: 'pattern', 'too-short', 'too-long', 'too-few-char-classes', 'too-weak', 'contains-email', 'contains-name', 'common-password', 'breached-password' and 'reused-password'
+type passwordViolation struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//commonPasswords has the bundled common passwords plus the ones in --password-dictionary-file, lower cased
+var commonPasswords = make(map[string]bool)
+
+//dictionaryWords are the common passwords with at least 4 characters, without leet substitutions, searched inside passwords when estimating their strength
+var dictionaryWords = make(map[string]bool)
+var dictionaryMaxLen = 0
+
+//leetChars maps common character substitutions back to letters before dictionary lookups
+var leetChars = map[rune]rune{'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', '@': 'a', '$': 's', '!': 'i', '+': 't'}
+
+//keyboardRows are used for detecting sequences of adjacent keys, as in 'qwerty' or 'asdf'
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+//parsePasswordPolicy parses a realm password policy. An empty policy has no rules
+func parsePasswordPolicy(policyJSON string) (*passwordPolicy, error) {
+	p := passwordPolicy{}
+	if policyJSON == "" {
+		return &p, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(policyJSON))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	if p.MinLength < 0 || p.MaxLength < 0 {
+		return nil, fmt.Errorf("minLength and maxLength can't be negative")
+	}
+	if p.MaxLength > 0 && p.MaxLength < p.MinLength {
+		return nil, fmt.Errorf("maxLength must be greater than minLength")
+	}
+	if p.MinCharClasses < 0 || p.MinCharClasses > 4 {
+		return nil, fmt.Errorf("minCharClasses must be between 0 and 4")
+	}
+	if p.MinStrength < 0 || p.MinStrength > 4 {
+		return nil, fmt.Errorf("minStrength must be between 0 and 4")
+	}
+	if (p.RejectBreached || p.ExpireBreached) && !breachedPasswordCheckEnabled() {
+		return nil, fmt.Errorf("rejectBreached and expireBreached require --breached-password-dataset or --breached-password-api-url")
+	}
+	return &p, nil
+}
+
+//loadCommonPasswords loads the bundled common passwords and the ones in the dictionary file (one per line), if informed
+func loadCommonPasswords(dictionaryFile string) error {
+	for _, w := range strings.Fields(commonPasswordList) {
+		addCommonPassword(w)
+	}
+	if dictionaryFile == "" {
+		return nil
+	}
+	f, err := os.Open(dictionaryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		addCommonPassword(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+func addCommonPassword(w string) {
+	w = strings.ToLower(strings.TrimSpace(w))
+	if w == "" {
+		return
+	}
+	commonPasswords[w] = true
+	if utf8.RuneCountInString(w) >= 4 {
+		dictionaryWords[unleet(w)] = true
+		if utf8.RuneCountInString(w) > dictionaryMaxLen {
+			dictionaryMaxLen = utf8.RuneCountInString(w)
+		}
+	}
+}
+
+//validatePassword returns the violations of a password against the realm regex and password policy. Email and name are used for rejecting personal info
+func validatePassword(r *realmInfo, password string, email string, name string) []passwordViolation {
+	violations := make([]passwordViolation, 0)
+	matched, _ := regexp.MatchString(r.PasswordValidationRegex, password)
+	if !matched {
+		violations = append(violations, passwordViolation{"pattern", "Password doesn't match the required pattern"})
+	}
+
+	p := r.passwordPolicy
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, passwordViolation{"too-short", fmt.Sprintf("Password must have at least %d characters", p.MinLength)})
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, passwordViolation{"too-long", fmt.Sprintf("Password must have at most %d characters", p.MaxLength)})
+	}
+	if p.MinCharClasses > 0 && len(passwordCharClasses(password)) < p.MinCharClasses {
+		violations = append(violations, passwordViolation{"too-few-char-classes", fmt.Sprintf("Password must have at least %d of: lowercase letters, uppercase letters, digits and symbols", p.MinCharClasses)})
+	}
+
+	userInputs := personalInfoWords(email, name)
+	if p.RejectPersonalInfo {
+		normalized := unleet(strings.ToLower(password))
+		for _, w := range personalInfoWords(email, "") {
+			if strings.Contains(normalized, unleet(w)) {
+				violations = append(violations, passwordViolation{"contains-email", "Password must not contain your email"})
+				break
+			}
+		}
+		for _, w := range personalInfoWords("", name) {
+			if strings.Contains(normalized, unleet(w)) {
+				violations = append(violations, passwordViolation{"contains-name", "Password must not contain your name"})
+				break
+			}
+		}
+	}
+	if p.RejectCommon && isCommonPassword(password) {
+		violations = append(violations, passwordViolation{"common-password", "Password is too common"})
+	}
+	if p.MinStrength > 0 && passwordStrength(password, userInputs) < p.MinStrength {
+		violations = append(violations, passwordViolation{"too-weak", "Password is too easy to guess. Use a longer password with less predictable words"})
+	}
+	if p.RejectBreached && passwordBreached(password) {
+		violations = append(violations, passwordViolation{"breached-password", "Password appeared in a data breach. Choose another password"})
+	}
+	return violations
+}
+
+func isCommonPassword(password string) bool {
+	lower := strings.ToLower(password)
+	return commonPasswords[lower] || commonPasswords[unleet(lower)]
+}
+
+//passwordCharClasses returns which of 'lower', 'upper', 'digit' and 'symbol' the password has
+func passwordCharClasses(password string) map[string]bool {
+	classes := make(map[string]bool)
+	for _, c := range password {
+		classes[charClass(c)] = true
+	}
+	return classes
+}
+
+func charClass(c rune) string {
+	switch {
+	case unicode.IsLower(c):
+		return "lower"
+	case unicode.IsUpper(c):
+		return "upper"
+	case unicode.IsDigit(c):
+		return "digit"
+	}
+	return "symbol"
+}
+
+//passwordStrength estimates how hard a password is to guess, from 0 (too guessable) to 4 (very unguessable), as zxcvbn scores.
+//Guesses are estimated by scanning the password for dictionary words (common passwords and the user's personal info, also with leet substitutions),
+//repeated characters and sequences (as in 'abc', '321' or adjacent keyboard keys), which add few guesses. Other characters add the brute force cardinality of the password
+func passwordStrength(password string, userInputs []string) int {
+	if password == "" || isCommonPassword(password) {
+		return 0
+	}
+	cardinality := 0.0
+	sizes := map[string]float64{"lower": 26, "upper": 26, "digit": 10, "symbol": 33}
+	for c := range passwordCharClasses(password) {
+		cardinality += sizes[c]
+	}
+	dictionaryBits := math.Log2(float64(len(commonPasswords)+len(userInputs))) + 1
+	inputs := make(map[string]bool)
+	maxWordLen := dictionaryMaxLen
+	for _, w := range userInputs {
+		inputs[unleet(w)] = true
+		if utf8.RuneCountInString(w) > maxWordLen {
+			maxWordLen = utf8.RuneCountInString(w)
+		}
+	}
+
+	runes := []rune(password)
+	normalized := []rune(unleet(strings.ToLower(password)))
+	bits := 0.0
+	for i := 0; i < len(runes); {
+		//longest dictionary word starting at i
+		wordLen := 0
+		for l := maxWordLen; l >= 3 && wordLen == 0; l-- {
+			if i+l <= len(normalized) && (dictionaryWords[string(normalized[i:i+l])] || inputs[string(normalized[i:i+l])]) {
+				wordLen = l
+			}
+		}
+		if wordLen > 0 {
+			bits += dictionaryBits
+			i += wordLen
+			continue
+		}
+		if i > 0 && (runes[i] == runes[i-1] || isSequence(runes[i-1], runes[i])) {
+			bits++
+		} else {
+			bits += math.Log2(cardinality)
+		}
+		i++
+	}
+
+	//score thresholds of zxcvbn: 10^3, 10^6, 10^8 and 10^10 guesses
+	switch {
+	case bits < 10:
+		return 0
+	case bits < 20:
+		return 1
+	case bits < 26.6:
+		return 2
+	case bits < 33.2:
+		return 3
+	}
+	return 4
+}
+
+//isSequence returns true if b follows a in the alphabet, in digits or in a keyboard row (in any direction)
+func isSequence(a rune, b rune) bool {
+	a = unicode.ToLower(a)
+	b = unicode.ToLower(b)
+	if charClass(a) == charClass(b) && charClass(a) != "symbol" && (b-a == 1 || a-b == 1) {
+		return true
+	}
+	for _, row := range keyboardRows {
+		ia := strings.IndexRune(row, a)
+		ib := strings.IndexRune(row, b)
+		if ia >= 0 && ib >= 0 && (ib-ia == 1 || ia-ib == 1) {
+			return true
+		}
+	}
+	return false
+}
+
+//personalInfoWords returns the parts of the email and name (with at least 3 characters) that must not be used in passwords
+func personalInfoWords(email string, name string) []string {
+	words := make([]string, 0)
+	local := strings.ToLower(strings.Split(email, "@")[0])
+	parts := strings.FieldsFunc(local+" "+strings.ToLower(name), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if utf8.RuneCountInString(local) >= 3 {
+		words = append(words, local)
+	}
+	for _, p := range parts {
+		if utf8.RuneCountInString(p) >= 3 && !isOneOf(p, words) {
+			words = append(words, p)
+		}
+	}
+	return words
+}
+
+func unleet(s string) string {
+	return strings.Map(func(c rune) rune {
+		l, exists := leetChars[c]
+		if exists {
+			return l
+		}
+		return c
+	}, s)
+}
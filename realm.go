@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultRealm = "default"
+
+//realmInfo is a realm along with its parsed keys and mail templates, ready to be used by handlers
+type realmInfo struct {
+	Realm
+	privateKey     interface{}
+	publicKey      interface{}
+	mailTemplates  map[string]MailTemplate
+	attributes     map[string]attributeSchema
+	passwordPolicy *passwordPolicy
+}
+
+var realmCache = struct {
+	sync.Mutex
+	realms   map[string]*realmInfo
+	loadDate time.Time
+}{}
+
+//realmMiddleware selects the realm by the ':realm' path param or by the Host header. Defaults to realm 'default'
+func realmMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		realms, err := loadRealms()
+		if err != nil {
+			logrus.Warnf("Couldn't load realms. err=%s", err)
+			c.AbortWithStatusJSON(500, gin.H{"message": "Server error"})
+			invocationCounter.WithLabelValues(c.Request.Method, c.FullPath(), "500").Inc()
+			return
+		}
+
+		name := c.Param("realm")
+		if name == "" {
+			name = defaultRealm
+			host := strings.ToLower(strings.Split(c.Request.Host, ":")[0])
+			for _, r := range realms {
+				for _, h := range strings.Split(r.Hosts, ",") {
+					if h != "" && strings.TrimSpace(strings.ToLower(h)) == host {
+						name = r.Name
+					}
+				}
+			}
+		}
+
+		r, exists := realms[name]
+		if !exists {
+			c.AbortWithStatusJSON(404, gin.H{"message": "Realm not found"})
+			invocationCounter.WithLabelValues(c.Request.Method, c.FullPath(), "404").Inc()
+			return
+		}
+		c.Set("realm", r)
+		c.Next()
+	}
+}
+
+func getRealm(c *gin.Context) *realmInfo {
+	return c.MustGet("realm").(*realmInfo)
+}
+
+//loadRealms returns all realms from a cache that is refreshed from database every minute
+func loadRealms() (map[string]*realmInfo, error) {
+	realmCache.Lock()
+	defer realmCache.Unlock()
+
+	if realmCache.realms != nil && time.Since(realmCache.loadDate) < 1*time.Minute {
+		return realmCache.realms, nil
+	}
+
+	logrus.Debugf("Loading realms from database")
+	rs := make([]Realm, 0)
+	err := db.Find(&rs).Error
+	if err != nil {
+		return nil, err
+	}
+	mts := make([]MailTemplate, 0)
+	err = db.Find(&mts).Error
+	if err != nil {
+		return nil, err
+	}
+
+	realms := make(map[string]*realmInfo)
+	for _, r := range rs {
+		ri := &realmInfo{Realm: r, mailTemplates: make(map[string]MailTemplate)}
+		if r.JWTSigningKey == "" {
+			ri.privateKey = opt.jwtPrivateKey
+			ri.publicKey = opt.jwtPublicKey
+		} else {
+			ri.privateKey, ri.publicKey, err = parseSigningKey(r.JWTSigningMethod, r.JWTSigningKey)
+			if err != nil {
+				logrus.Warnf("Couldn't parse signing key of realm %s. Ignoring realm. err=%s", r.Name, err)
+				continue
+			}
+		}
+		ri.attributes, err = parseAttributesSchema(r.AttributesSchema)
+		if err != nil {
+			logrus.Warnf("Couldn't parse attributes schema of realm %s. Ignoring custom attributes. err=%s", r.Name, err)
+			ri.attributes = make(map[string]attributeSchema)
+		}
+		ri.passwordPolicy, err = parsePasswordPolicy(r.PasswordPolicy)
+		if err != nil {
+			logrus.Warnf("Couldn't parse password policy of realm %s. Only the password validation regex will be used. err=%s", r.Name, err)
+			ri.passwordPolicy = &passwordPolicy{}
+		}
+		realms[r.Name] = ri
+	}
+	for _, mt := range mts {
+		ri, exists := realms[mt.Realm]
+		if exists {
+			ri.mailTemplates[mt.Name] = mt
+		}
+	}
+
+	realmCache.realms = realms
+	realmCache.loadDate = time.Now()
+	return realms, nil
+}
+
+func invalidateRealmCache() {
+	realmCache.Lock()
+	defer realmCache.Unlock()
+	realmCache.realms = nil
+}
+
+//mailTemplate returns the realm mail template with the given name. ok is false if it is not configured
+func (r *realmInfo) mailTemplate(name string) (subject string, html string, ok bool) {
+	mt, exists := r.mailTemplates[name]
+	if !exists || mt.Subject == "" || mt.HTML == "" {
+		return "", "", false
+	}
+	return mt.Subject, mt.HTML, true
+}
+
+//syncDefaultRealm writes the configuration from startup parameters to the 'default' realm
+func syncDefaultRealm() error {
+	r := Realm{
+		Name:                    defaultRealm,
+		JWTIssuer:               opt.jwtIssuer,
+		JWTSigningMethod:        opt.jwtSigningMethod,
+		PasswordValidationRegex: opt.passwordValidationRegex,
+		AccountActivationMethod: opt.accountActivationMethod,
+		SignupMethod:            opt.signupMethod,
+		ActivationTokenFormat:   opt.activationTokenFormat,
+		TokenSubject:            opt.tokenSubject,
+		AttributesSchema:        opt.attributesSchema,
+		PasswordPolicy:          opt.passwordPolicy,
+		MailSMTPHost:            opt.mailSMTPHost,
+		MailSMTPPort:            opt.mailSMTPPort,
+		MailSMTPUser:            opt.mailSMTPUser,
+		MailSMTPPass:            opt.mailSMTPPass,
+		MailFromAddress:         opt.mailFromAddress,
+		MailFromName:            opt.mailFromName,
+		GoogleClientID:          opt.googleClientID,
+		GoogleClientSecret:      opt.googleClientSecret,
+		FacebookClientID:        opt.facebookClientID,
+		FacebookClientSecret:    opt.facebookClientSecret,
+		PreSignupHookURL:        opt.preSignupHookURL,
+		PreSignupHookTimeout:    opt.preSignupHookTimeout,
+		PreSignupHookFailPolicy: opt.preSignupHookFailPolicy,
+		PreTokenHookURL:         opt.preTokenHookURL,
+		PreTokenHookTimeout:     opt.preTokenHookTimeout,
+		PreTokenHookFailPolicy:  opt.preTokenHookFailPolicy,
+		HooksSecret:             opt.hooksSecret,
+		CreationDate:            time.Now(),
+	}
+	var existing Realm
+	if !db.First(&existing, "name = ?", defaultRealm).RecordNotFound() {
+		r.Hosts = existing.Hosts
+		r.CreationDate = existing.CreationDate
+	}
+	err := db.Save(&r).Error
+	if err != nil {
+		return err
+	}
+
+	templates := []MailTemplate{
+		{Realm: defaultRealm, Name: "activation", Subject: opt.mailActivationSubject, HTML: opt.mailActivationHTMLBody},
+		{Realm: defaultRealm, Name: "password-reset", Subject: opt.mailResetPasswordSubject, HTML: opt.mailResetPasswordHTMLBody},
+		{Realm: defaultRealm, Name: "invitation", Subject: opt.mailInvitationSubject, HTML: opt.mailInvitationHTMLBody},
+		{Realm: defaultRealm, Name: "approval", Subject: opt.mailApprovalSubject, HTML: opt.mailApprovalHTMLBody},
+		{Realm: defaultRealm, Name: "rejection", Subject: opt.mailRejectionSubject, HTML: opt.mailRejectionHTMLBody},
+		{Realm: defaultRealm, Name: "email-change", Subject: opt.mailEmailChangeSubject, HTML: opt.mailEmailChangeHTMLBody},
+		{Realm: defaultRealm, Name: "email-change-notification", Subject: opt.mailEmailChangeNotificationSubject, HTML: opt.mailEmailChangeNotificationHTMLBody},
+		{Realm: defaultRealm, Name: "account-deletion", Subject: opt.mailAccountDeletionSubject, HTML: opt.mailAccountDeletionHTMLBody},
+		{Realm: defaultRealm, Name: "new-signin", Subject: opt.mailNewSigninSubject, HTML: opt.mailNewSigninHTMLBody},
+		{Realm: defaultRealm, Name: "password-expiration", Subject: opt.mailPasswordExpirationSubject, HTML: opt.mailPasswordExpirationHTMLBody},
+		{Realm: defaultRealm, Name: "account-locked", Subject: opt.mailAccountLockedSubject, HTML: opt.mailAccountLockedHTMLBody},
+	}
+	for _, mt := range templates {
+		err := db.Save(&mt).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//generateSigningKey creates a new PEM encoded private key suitable for the JWT signing method
+func generateSigningKey(signingMethod string) (string, error) {
+	var der []byte
+	var err error
+	switch signingMethod {
+	case "ES256", "ES384", "ES512":
+		curves := map[string]elliptic.Curve{"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521()}
+		k, err1 := ecdsa.GenerateKey(curves[signingMethod], rand.Reader)
+		if err1 != nil {
+			return "", err1
+		}
+		der, err = x509.MarshalPKCS8PrivateKey(k)
+	case "RS256", "RS384", "RS512":
+		k, err1 := rsa.GenerateKey(rand.Reader, 2048)
+		if err1 != nil {
+			return "", err1
+		}
+		der, err = x509.MarshalPKCS8PrivateKey(k)
+	default:
+		return "", fmt.Errorf("Unsupported signing method %s for key generation", signingMethod)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+//parseSigningKey loads the private and related public key from a PEM encoded private key
+func parseSigningKey(signingMethod string, pemKey string) (interface{}, interface{}, error) {
+	var block *pem.Block
+	rest := []byte(pemKey)
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, nil, fmt.Errorf("Couldn't find a private key PEM block")
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			break
+		}
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if !strings.HasPrefix(signingMethod, "ES") {
+			return nil, nil, fmt.Errorf("EC key can't be used with signing method %s", signingMethod)
+		}
+		return k, &k.PublicKey, nil
+	case *rsa.PrivateKey:
+		if !strings.HasPrefix(signingMethod, "RS") {
+			return nil, nil, fmt.Errorf("RSA key can't be used with signing method %s", signingMethod)
+		}
+		return k, &k.PublicKey, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported key type for signing method %s", signingMethod)
+}
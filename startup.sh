@@ -18,13 +18,70 @@ userme \
      --refreshtoken-expiration-minutes=$REFRESH_TOKEN_EXPIRATION_MINUTES \
      --validationtoken-expiration-minutes=$VALIDATION_TOKEN_EXPIRATION_MINUTES \
      --passwordresettoken-expiration-minutes=$PASSWORD_RESET_TOKEN_EXPIRATION_MINUTES \
+     --invitationtoken-expiration-minutes=$INVITATION_TOKEN_EXPIRATION_MINUTES \
+     --emailchange-undo-expiration-minutes=$EMAILCHANGE_UNDO_EXPIRATION_MINUTES \
      --password-retries-max=$INCORRECT_PASSWORD_MAX_RETRIES \
      --password-retries-time=$INCORRENT_PASSWORD_TIME_SECONDS \
+     --password-lockout-minutes=$PASSWORD_LOCKOUT_MINUTES \
+     --unlocktoken-expiration-minutes=$UNLOCK_TOKEN_EXPIRATION_MINUTES \
+     --trusted-proxies="$TRUSTED_PROXIES" \
+     --ip-failures-window-minutes=$IP_FAILURES_WINDOW_MINUTES \
+     --ip-failures-delay-threshold=$IP_FAILURES_DELAY_THRESHOLD \
+     --ip-failures-delay-seconds=$IP_FAILURES_DELAY_SECONDS \
+     --ip-failures-ban-threshold=$IP_FAILURES_BAN_THRESHOLD \
+     --subnet-failures-delay-threshold=$SUBNET_FAILURES_DELAY_THRESHOLD \
+     --subnet-failures-ban-threshold=$SUBNET_FAILURES_BAN_THRESHOLD \
+     --ip-ban-minutes=$IP_BAN_MINUTES \
      --password-expiration-days=$PASSWORD_EXPIRATION_DAYS \
+     --password-expiration-warning-days=$PASSWORD_EXPIRATION_WARNING_DAYS \
+     --password-history-size=$PASSWORD_HISTORY_SIZE \
+     --password-min-age-hours=$PASSWORD_MIN_AGE_HOURS \
+     --password-policy="$PASSWORD_POLICY" \
+     --password-dictionary-file="$PASSWORD_DICTIONARY_FILE" \
+     --breached-password-dataset="$BREACHED_PASSWORD_DATASET" \
+     --breached-password-api-url="$BREACHED_PASSWORD_API_URL" \
+     --breached-password-api-timeout=$BREACHED_PASSWORD_API_TIMEOUT \
+     --password-hash-algorithm=$PASSWORD_HASH_ALGORITHM \
+     --password-bcrypt-cost=$PASSWORD_BCRYPT_COST \
+     --password-argon2-memory=$PASSWORD_ARGON2_MEMORY \
+     --password-argon2-iterations=$PASSWORD_ARGON2_ITERATIONS \
+     --password-argon2-parallelism=$PASSWORD_ARGON2_PARALLELISM \
+     --password-scrypt-cost=$PASSWORD_SCRYPT_COST \
+     --password-pepper="$PASSWORD_PEPPER" \
      --account-activation-method=$ACCOUNT_ACTIVATION_METHOD \
+     --activation-token-format=$ACTIVATION_TOKEN_FORMAT \
+     --activation-resend-interval-seconds=$ACTIVATION_RESEND_INTERVAL_SECONDS \
+     --signup-method=$SIGNUP_METHOD \
      --password-validation-regex=$PASSWORD_VALIDATION_REGEX \
      --jwt-signing-key-file=$JWT_SIGNING_KEY_FILE \
      --jwt-signing-method=$JWT_SIGNING_METHOD \
+     --token-subject=$TOKEN_SUBJECT \
+     --attributes-schema="$ATTRIBUTES_SCHEMA" \
+     --blob-storage=$BLOB_STORAGE \
+     --blob-storage-dir=$BLOB_STORAGE_DIR \
+     --s3-endpoint=$S3_ENDPOINT \
+     --s3-region=$S3_REGION \
+     --s3-bucket=$S3_BUCKET \
+     --s3-access-key=$S3_ACCESS_KEY \
+     --s3-secret-key=$S3_SECRET_KEY \
+     --avatar-max-size-bytes=$AVATAR_MAX_SIZE_BYTES \
+     --avatar-size-pixels=$AVATAR_SIZE_PIXELS \
+     --account-deletion-grace-days=$ACCOUNT_DELETION_GRACE_DAYS \
+     --account-deletion-mode=$ACCOUNT_DELETION_MODE \
+     --audit-retention-days=$AUDIT_RETENTION_DAYS \
+     --webhook-max-attempts=$WEBHOOK_MAX_ATTEMPTS \
+     --webhook-retry-seconds=$WEBHOOK_RETRY_SECONDS \
+     --pre-signup-hook-url="$PRE_SIGNUP_HOOK_URL" \
+     --pre-signup-hook-timeout=$PRE_SIGNUP_HOOK_TIMEOUT \
+     --pre-signup-hook-fail-policy=$PRE_SIGNUP_HOOK_FAIL_POLICY \
+     --pre-token-hook-url="$PRE_TOKEN_HOOK_URL" \
+     --pre-token-hook-timeout=$PRE_TOKEN_HOOK_TIMEOUT \
+     --pre-token-hook-fail-policy=$PRE_TOKEN_HOOK_FAIL_POLICY \
+     --hooks-secret="$HOOKS_SECRET" \
+     --event-broker=$EVENT_BROKER \
+     --event-broker-url="$EVENT_BROKER_URL" \
+     --event-broker-retry-seconds=$EVENT_BROKER_RETRY_SECONDS \
+     --event-subject-prefix=$EVENT_SUBJECT_PREFIX \
      --master-public-key-file=$MASTER_PUBLIC_KEY_FILE \
      \
      --mail-smtp-host=$MAIL_SMTP_HOST \
@@ -37,6 +94,24 @@ userme \
      --mail-activation-html="$MAIL_ACTIVATION_HTML" \
      --mail-password-reset-subject="$MAIL_PASSWORD_RESET_SUBJECT" \
      --mail-password-reset-html="$MAIL_PASSWORD_RESET_HTML" \
+     --mail-invitation-subject="$MAIL_INVITATION_SUBJECT" \
+     --mail-invitation-html="$MAIL_INVITATION_HTML" \
+     --mail-approval-subject="$MAIL_APPROVAL_SUBJECT" \
+     --mail-approval-html="$MAIL_APPROVAL_HTML" \
+     --mail-rejection-subject="$MAIL_REJECTION_SUBJECT" \
+     --mail-rejection-html="$MAIL_REJECTION_HTML" \
+     --mail-email-change-subject="$MAIL_EMAIL_CHANGE_SUBJECT" \
+     --mail-email-change-html="$MAIL_EMAIL_CHANGE_HTML" \
+     --mail-email-change-notification-subject="$MAIL_EMAIL_CHANGE_NOTIFICATION_SUBJECT" \
+     --mail-email-change-notification-html="$MAIL_EMAIL_CHANGE_NOTIFICATION_HTML" \
+     --mail-account-deletion-subject="$MAIL_ACCOUNT_DELETION_SUBJECT" \
+     --mail-account-deletion-html="$MAIL_ACCOUNT_DELETION_HTML" \
+     --mail-new-signin-subject="$MAIL_NEW_SIGNIN_SUBJECT" \
+     --mail-new-signin-html="$MAIL_NEW_SIGNIN_HTML" \
+     --mail-password-expiration-subject="$MAIL_PASSWORD_EXPIRATION_SUBJECT" \
+     --mail-password-expiration-html="$MAIL_PASSWORD_EXPIRATION_HTML" \
+     --mail-account-locked-subject="$MAIL_ACCOUNT_LOCKED_SUBJECT" \
+     --mail-account-locked-html="$MAIL_ACCOUNT_LOCKED_HTML" \
      --mail-tokens-tests=$MAIL_TOKENS_FOR_TESTS \
      \
      --google-client-id=$GOOGLE_CLIENT_ID \
@@ -0,0 +1,48 @@
+# webhook receiver and hook endpoint used by the Postman tests
+# POST /webhook/<key> records the request, GET /webhook/<key> returns the recorded requests and POST /fail always fails
+# POST /hook denies signups of emails starting with 'blocked' and adds a 'plan' claim to access tokens
+import json
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+received = {}
+
+
+class Handler(BaseHTTPRequestHandler):
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get('Content-Length', 0))).decode()
+        if self.path.startswith('/webhook/'):
+            received.setdefault(self.path, []).append({
+                'event': self.headers.get('X-Userme-Event'),
+                'delivery': self.headers.get('X-Userme-Delivery'),
+                'timestamp': self.headers.get('X-Userme-Timestamp'),
+                'signature': self.headers.get('X-Userme-Signature'),
+                'body': body,
+            })
+            self.respond(204)
+            return
+        if self.path == '/hook':
+            req = json.loads(body)
+            if req['type'] == 'pre-signup' and req['email'].startswith('blocked'):
+                self.respond(200, {'allow': False, 'message': 'Signups from this email are not allowed'})
+                return
+            self.respond(200, {'allow': True, 'claims': {'plan': 'gold'}})
+            return
+        self.respond(500, {'message': 'Failing on purpose'})
+
+    def do_GET(self):
+        self.respond(200, received.get(self.path, []))
+
+    def respond(self, status, body=None):
+        self.send_response(status)
+        if body is None:
+            self.end_headers()
+            return
+        data = json.dumps(body).encode()
+        self.send_header('Content-Type', 'application/json')
+        self.send_header('Content-Length', str(len(data)))
+        self.end_headers()
+        self.wfile.write(data)
+
+
+ThreadingHTTPServer(('0.0.0.0', 8000), Handler).serve_forever()
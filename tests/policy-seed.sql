@@ -0,0 +1,13 @@
+-- Accounts that can't be created through the API, loaded into the database of the 'userme-policy' service of docker-compose.test.yml
+
+-- legacy@test.com / legacy-pass-1. bcrypt hash with the minimum cost, as created by older versions
+INSERT INTO users (id, realm, name, email, password_hash, password_date, activation_date, mail_verified_date, approval_status, activation_code_hash, roles, locale, timezone, phone, custom_attributes, avatar_key)
+VALUES ('00000000-0000-0000-0000-000000000044', 'default', 'Legacy User', 'legacy@test.com', '$2a$04$TSyVKQLu8xAENUG1DHIjvep4k8TRD.MG9q6Eh7H6FWgOFi0mXFmHG', '2020-01-01 00:00:00', '2020-01-01 00:00:00', '2020-01-01 00:00:00', '', '', '', '', '', '', '', '');
+
+-- breached@test.com / breached-pass-2. Created before the password was found in a data breach (tests/breached-passwords.txt)
+INSERT INTO users (id, realm, name, email, password_hash, password_date, activation_date, mail_verified_date, approval_status, activation_code_hash, roles, locale, timezone, phone, custom_attributes, avatar_key)
+VALUES ('00000000-0000-0000-0000-000000000047', 'default', 'Breached User', 'breached@test.com', '$2a$04$gDiHR7avPMwy2B.FLddzyeaPrSq3p06l8tsGJB9ej3PbrtyFaQvlu', '2020-01-01 00:00:00', '2020-01-01 00:00:00', '2020-01-01 00:00:00', '', '', '', '', '', '', '', '');
+
+-- expired@test.com / expired-pass-1. Password expired, as if PASSWORD_EXPIRATION_DAYS had passed
+INSERT INTO users (id, realm, name, email, password_hash, password_date, password_valid_until, activation_date, mail_verified_date, approval_status, activation_code_hash, roles, locale, timezone, phone, custom_attributes, avatar_key)
+VALUES ('00000000-0000-0000-0000-000000000048', 'default', 'Expired User', 'expired@test.com', '$2a$04$D.gYpjeDOUQLHAqQ5CLl4.xs9CUwYOJ6G7GirV6gEi/YV60vxcoUW', '2020-01-01 00:00:00', '2020-04-01 00:00:00', '2020-01-01 00:00:00', '2020-01-01 00:00:00', '', '', '', '', '', '', '', '');
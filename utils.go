@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
 	"strings"
 	"time"
@@ -16,7 +20,7 @@ import (
 	"github.com/go-gomail/gomail"
 )
 
-func sendMail(subject string, htmlBody string, mailTo string, mailToName string) error {
+func sendMail(r *realmInfo, subject string, htmlBody string, mailTo string, mailToName string) error {
 	logrus.Infof("Sending mail %s - %s", mailTo, subject)
 
 	if !strings.HasPrefix(strings.ToLower(htmlBody), "<html>") {
@@ -24,25 +28,25 @@ func sendMail(subject string, htmlBody string, mailTo string, mailToName string)
 	}
 
 	m := gomail.NewMessage(gomail.SetEncoding("8bit"))
-	m.SetAddressHeader("From", opt.mailFromAddress, opt.mailFromName)
+	m.SetAddressHeader("From", r.MailFromAddress, r.MailFromName)
 	m.SetAddressHeader("To", mailTo, mailToName)
 	m.SetHeader("Subject", subject)
-	m.SetHeader("Message-ID", fmt.Sprintf("<%s-%s>", uuid.New().String(), opt.mailFromAddress))
+	m.SetHeader("Message-ID", fmt.Sprintf("<%s-%s>", uuid.New().String(), r.MailFromAddress))
 	// m.SetAddressHeader("Cc", "dan@example.com", "Dan")
 	// m.Attach("/home/Alex/lolcat.jpg")
 	m.SetBody("text/html", htmlBody)
 
-	d := gomail.NewDialer(opt.mailSMTPHost, opt.mailSMTPPort, opt.mailSMTPUser, opt.mailSMTPPass)
+	d := gomail.NewDialer(r.MailSMTPHost, r.MailSMTPPort, r.MailSMTPUser, r.MailSMTPPass)
 
 	return d.DialAndSend(m)
 }
 
-func createJWTToken(email string, expirationMinutes int, typ string, authType string, customClaims jwt.MapClaims) (jwt.MapClaims, string, error) {
-	sm := jwt.GetSigningMethod(opt.jwtSigningMethod)
+func createJWTToken(r *realmInfo, subject string, expirationMinutes int, typ string, authType string, customClaims jwt.MapClaims) (jwt.MapClaims, string, error) {
+	sm := jwt.GetSigningMethod(r.JWTSigningMethod)
 	jti := uuid.New()
 	claims := jwt.MapClaims{
-		"iss":      opt.jwtIssuer,
-		"sub":      email,
+		"iss":      r.JWTIssuer,
+		"sub":      subject,
 		"exp":      time.Now().Unix() + int64(60*expirationMinutes),
 		"iat":      time.Now().Unix(),
 		"nbf":      time.Now().Unix(),
@@ -56,11 +60,22 @@ func createJWTToken(email string, expirationMinutes int, typ string, authType st
 		}
 	}
 	token := jwt.NewWithClaims(sm, claims)
-	tokenString, err := token.SignedString(opt.jwtPrivateKey)
+	tokenString, err := token.SignedString(r.privateKey)
 	return claims, tokenString, err
 }
 
-func loadAuthorizationToken(request *http.Request) (jwt.MapClaims, error) {
+func loadAuthorizationToken(r *realmInfo, request *http.Request) (jwt.MapClaims, error) {
+	claims, err := loadAuthorizationTokenWithKey(request, r.publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if !claimEquals(claims, "iss", r.JWTIssuer) {
+		return nil, fmt.Errorf("Token was not issued for realm %s", r.Name)
+	}
+	return claims, nil
+}
+
+func loadAuthorizationTokenWithKey(request *http.Request, publicKey interface{}) (jwt.MapClaims, error) {
 	v, exists := request.Header["Authorization"]
 	if !exists {
 		return nil, fmt.Errorf("Authorization header not found")
@@ -68,7 +83,7 @@ func loadAuthorizationToken(request *http.Request) (jwt.MapClaims, error) {
 	tokenContents := strings.Replace(v[0], "Bearer ", "", 1)
 	claims := &jwt.MapClaims{}
 	token, err := jwt.ParseWithClaims(tokenContents, claims, func(token *jwt.Token) (interface{}, error) {
-		return opt.jwtPublicKey, nil
+		return publicKey, nil
 	})
 	if err != nil {
 		return nil, err
@@ -79,6 +94,14 @@ func loadAuthorizationToken(request *http.Request) (jwt.MapClaims, error) {
 	return *claims, nil
 }
 
+//loadAndValidateMasterToken validates tokens signed by the master key. Those are used on admin APIs
+func loadAndValidateMasterToken(request *http.Request) (jwt.MapClaims, error) {
+	if opt.masterPublicKey == nil {
+		return nil, fmt.Errorf("Master public key not configured")
+	}
+	return loadAuthorizationTokenWithKey(request, opt.masterPublicKey)
+}
+
 func claimEquals(claims jwt.MapClaims, claimName string, value string) bool {
 	v, exists := claims[claimName]
 	if !exists {
@@ -87,13 +110,33 @@ func claimEquals(claims jwt.MapClaims, claimName string, value string) bool {
 	return v == value
 }
 
-func createAccessAndRefreshToken(name string, email string, authType string, accessTokenClaims jwt.MapClaims, refreshTokenClaims jwt.MapClaims) (gin.H, error) {
-	accessToken, accessTokenStr, err := createJWTToken(email, opt.accessTokenDefaultExpirationMinutes, "access", authType, accessTokenClaims)
+//createAccessAndRefreshToken creates user tokens. 'sub' is the user id, unless the realm token subject is 'email' (legacy behaviour). Custom attributes mapped to claims by the realm schema are added to the access token
+func createAccessAndRefreshToken(r *realmInfo, u *User, authType string, accessTokenClaims jwt.MapClaims, refreshTokenClaims jwt.MapClaims) (gin.H, error) {
+	subject := u.ID
+	if r.TokenSubject == "email" {
+		subject = u.Email
+	}
+	if accessTokenClaims == nil {
+		accessTokenClaims = jwt.MapClaims{}
+	}
+	accessTokenClaims["email"] = u.Email
+	for k, v := range attributeClaims(r.attributes, u.CustomAttributes) {
+		_, exists := accessTokenClaims[k]
+		if !exists {
+			accessTokenClaims[k] = v
+		}
+	}
+	if refreshTokenClaims == nil {
+		refreshTokenClaims = jwt.MapClaims{}
+	}
+	refreshTokenClaims["email"] = u.Email
+
+	accessToken, accessTokenStr, err := createJWTToken(r, subject, opt.accessTokenDefaultExpirationMinutes, "access", authType, accessTokenClaims)
 	if err != nil {
 		return nil, fmt.Errorf("accessToken err=%s", err)
 	}
 
-	refreshToken, refreshTokenStr, err := createJWTToken(email, opt.refreshTokenDefaultExpirationMinutes, "refresh", authType, refreshTokenClaims)
+	refreshToken, refreshTokenStr, err := createJWTToken(r, subject, opt.refreshTokenDefaultExpirationMinutes, "refresh", authType, refreshTokenClaims)
 	if err != nil {
 		return nil, fmt.Errorf("refreshToken err=%s", err)
 	}
@@ -111,8 +154,9 @@ func createAccessAndRefreshToken(name string, email string, authType string, acc
 	rt := time.Unix(re, 0)
 
 	return gin.H{
-		"email":                  email,
-		"name":                   name,
+		"id":                     u.ID,
+		"email":                  u.Email,
+		"name":                   u.Name,
 		"accessToken":            accessTokenStr,
 		"accessTokenExpiration":  at.Format(time.RFC3339),
 		"refreshToken":           refreshTokenStr,
@@ -120,8 +164,8 @@ func createAccessAndRefreshToken(name string, email string, authType string, acc
 	}, nil
 }
 
-func loadAndValidateToken(req *http.Request, tokenType string, email string) (jwt.MapClaims, error) {
-	claims, err := loadAuthorizationToken(req)
+func loadAndValidateToken(r *realmInfo, req *http.Request, tokenType string, email string) (jwt.MapClaims, error) {
+	claims, err := loadAuthorizationToken(r, req)
 	if err != nil {
 		return nil, err
 	}
@@ -130,15 +174,47 @@ func loadAndValidateToken(req *http.Request, tokenType string, email string) (jw
 		return nil, fmt.Errorf("Token type is not %s for %s", tokenType, email)
 	}
 
+	//user tokens follow the account, so the email must be the current email of the user the token was issued to
 	if email != "" {
-		if !claimEquals(claims, "sub", email) {
-			return nil, fmt.Errorf("Token sub is not %s", email)
+		typ, _ := claims["typ"].(string)
+		if !isOneOf(typ, userTokenTypes) {
+			sub, _ := claims["sub"].(string)
+			if sub != email {
+				return nil, fmt.Errorf("Token email is not %s", email)
+			}
+		} else {
+			u, err := loadTokenUser(r, claims)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't load token user. err=%s", err)
+			}
+			if u.Email != email {
+				return nil, fmt.Errorf("Token user email is not %s", email)
+			}
 		}
 	}
 
 	return claims, nil
 }
 
+//userTokenTypes are the token types whose 'sub' is the user id (or the email for realms with legacy token subject). Other tokens are mailed to an address and have the email as 'sub'
+var userTokenTypes = []string{"access", "refresh"}
+
+//loadTokenUser loads the user a token was issued to by its 'sub'
+func loadTokenUser(r *realmInfo, claims jwt.MapClaims) (User, error) {
+	var u User
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return u, fmt.Errorf("Token doesn't have 'sub' claim")
+	}
+	column := "email"
+	typ, _ := claims["typ"].(string)
+	if isOneOf(typ, userTokenTypes) && r.TokenSubject != "email" {
+		column = "id"
+	}
+	err := db.First(&u, "realm = ? AND "+column+" = ?", r.Name, sub).Error
+	return u, err
+}
+
 func requestURLWithJsonResponse(method string, url string, body string, contentType string, customHeaders map[string]string, expectedStatus int) (map[string]interface{}, error) {
 	b := strings.NewReader(body)
 	req, err := http.NewRequest(method, url, b)
@@ -174,3 +250,23 @@ func requestURLWithJsonResponse(method string, url string, body string, contentT
 
 	return resp, nil
 }
+
+//renderMailTemplate replaces placeholders in mail templates. Use pairs of placeholder, value as in strings.NewReplacer. Placeholders containing other placeholders (EMAIL_CHANGE_TOKEN contains EMAIL) must come first
+func renderMailTemplate(template string, placeholderValues ...string) string {
+	return strings.NewReplacer(placeholderValues...).Replace(template)
+}
+
+//generateNumericCode returns a random code with the given number of digits
+func generateNumericCode(digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+func hashActivationCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}